@@ -0,0 +1,59 @@
+package api
+
+import (
+	"github.com/cormacrelf/mec-db/peers"
+	"github.com/cormacrelf/mec-db/ring"
+	"github.com/cormacrelf/mec-db/store"
+	"net/http"
+)
+
+// Cluster administration endpoints
+
+// GetPeers lists every peer we know of with its health.
+func GetPeers(pl *peers.PeerList, enc Encoder, res http.ResponseWriter) (int, string) {
+	return respond(res, enc, http.StatusOK, "peers", pl.Health())
+}
+
+type placement struct {
+	Zones      int
+	Replicas   int
+	Violations []ring.Violation
+}
+
+// GetPlacement reports partitions whose replicas aren't spread over as many
+// zones as they could be.
+func GetPlacement(pl *peers.PeerList, s *store.Store, enc Encoder, res http.ResponseWriter) (int, string) {
+	r, n := pl.Ring(), s.Quorum().N
+	return respond(res, enc, http.StatusOK, "placement", placement{r.Zones(), n, r.Violations(n)})
+}
+
+// A LeaveFunc hands this node's keys to the rest of the cluster and then
+// takes the node out of it, returning how many keys were handed off and
+// how many weren't.
+type LeaveFunc func() (int, int, error)
+
+type leaveResult struct {
+	Handed int
+	Failed int
+	Error  string `json:",omitempty"`
+}
+
+// Leave is a graceful leave. It answers once the handoff is over, just
+// before the node goes away.
+func Leave(leave LeaveFunc, enc Encoder, res http.ResponseWriter) (int, string) {
+	sent, failed, err := leave()
+	if err != nil {
+		return respond(res, enc, http.StatusBadGateway, "leave", leaveResult{sent, failed, err.Error()})
+	}
+	return respond(res, enc, http.StatusOK, "leave", leaveResult{sent, failed, ""})
+}
+
+// A RestartFunc asks every node in the cluster to restart
+type RestartFunc func()
+
+// Restart restarts the whole cluster: each node shuts down cleanly and exits
+// with status 2, for its supervisor to start it again.
+func Restart(restart RestartFunc, enc Encoder, res http.ResponseWriter) (int, string) {
+	restart()
+	return respond(res, enc, http.StatusAccepted, "restart", struct{ Restarting bool }{true})
+}
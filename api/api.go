@@ -1,109 +1,80 @@
 package api
 
 import (
-	"bytes"
-	"fmt"
 	"github.com/codegangsta/martini"
+	apierrors "github.com/cormacrelf/mec-db/api/apierrors"
+	"github.com/cormacrelf/mec-db/logging"
 	"github.com/cormacrelf/mec-db/store"
+	"github.com/cormacrelf/mec-db/trace"
 	"github.com/jmhodges/levigo"
 	"io/ioutil"
-	"mime/multipart"
 	"net/http"
-	"net/textproto"
-	"time"
 )
 
 // The MecDB embedded martini webserver
 
-func GetRoot(db *levigo.DB, params martini.Params) (int, string) {
-	return 200, "stub"
+func Get(s *store.Store, rlog *logging.Logger, sp *trace.Span, enc Encoder, params martini.Params, res http.ResponseWriter, req *http.Request) {
+	get(s.WithLog(rlog), sp, enc, params["key"], res, req)
 }
 
-func Get(s *store.Store, params martini.Params, res http.ResponseWriter, req *http.Request) {
-	key, _ := params["key"]
+func get(s keyStore, sp *trace.Span, enc Encoder, key string, res http.ResponseWriter, req *http.Request) {
 	client := req.Header.Get("X-Mec-Client-ID")
 
-	maybe, b64, err := s.APIRead(key, client)
+	maybe, b64, err := s.APIRead(sp, key, client)
 	res.Header().Set("X-Mec-Vclock", b64)
 
-	if !maybe.Multi && err == nil {
-		rv := maybe.Single
-		res.Header().Set("Content-Type", rv.Content_Type)
-		t := time.Unix(0, rv.Timestamp)
-		res.Header().Set("Last-Modified", t.Format(http.TimeFormat))
-		res.Header().Set("X-Mec-Timestamp", fmt.Sprintf("%d", rv.Timestamp))
-		res.WriteHeader(http.StatusOK)
-		res.Write([]byte(rv.Value))
+	if err != nil {
+		writeError(res, enc, err)
 		return
 	}
 
-	if maybe.Multi && err == nil {
-		res.Header().Set("Content-Type", "mime/multipart")
-		body := &bytes.Buffer{}
-		writer := multipart.NewWriter(body)
-		for _, rv := range maybe.Multiple {
-			header := make(textproto.MIMEHeader)
-			header.Set("Content-Type", rv.Content_Type)
-			t := time.Unix(0, rv.Timestamp)
-			header.Set("Last-Modified", t.Format(http.TimeFormat))
-			header.Set("X-Mec-Timestamp", fmt.Sprintf("%d", rv.Timestamp))
-			iow, errc := writer.CreatePart(header)
-			if errc != nil {
-				continue
-			}
-			data := []byte(rv.Value)
-			iow.Write(data)
+	if vtag := req.URL.Query().Get("vtag"); vtag != "" {
+		rv, ok := maybe.Find(vtag)
+		if !ok {
+			writeError(res, enc, apierrors.NewError(http.StatusNotFound, "no sibling with that vtag"))
+			return
 		}
-
-		res.WriteHeader(http.StatusMultipleChoices) // 300
-		res.Write(body.Bytes())
+		// the clock is still for every sibling, so writing this one back
+		// resolves them
+		writeValue(res, rv)
 		return
 	}
 
-	if err != nil {
-		// return http.StatusNotFound, Must(enc.Encode(
-		// 	NewError(ErrCodeNotExist, fmt.Sprintf("key %s does not exist", params["key"]))))
-		res.WriteHeader(err.Code)
-		res.Write([]byte(err.Error()))
-		return
-	}
+	writeMaybe(res, req, maybe, b64)
+}
 
-	res.WriteHeader(http.StatusOK)
-	res.Write(nil)
-	return
+func Post(s *store.Store, rlog *logging.Logger, sp *trace.Span, enc Encoder, params martini.Params, res http.ResponseWriter, req *http.Request) {
+	Put(s, rlog, sp, enc, params, res, req)
 }
 
-func Post(s *store.Store, params martini.Params, res http.ResponseWriter, req *http.Request) (int, string) {
-	return Put(s, params, res, req)
+// Put writes the request body to the key. With ?returnbody=true it answers
+// like a GET straight after the write would, from the replicas it wrote to.
+func Put(s *store.Store, rlog *logging.Logger, sp *trace.Span, enc Encoder, params martini.Params, res http.ResponseWriter, req *http.Request) {
+	put(s.WithLog(rlog), sp, enc, params["key"], res, req)
 }
 
-func Put(s *store.Store, params martini.Params, res http.ResponseWriter, req *http.Request) (int, string) {
-	key, _ := params["key"]
+func put(s keyStore, sp *trace.Span, enc Encoder, key string, res http.ResponseWriter, req *http.Request) {
 	value, _ := ioutil.ReadAll(req.Body)
 	req.Body.Close()
 	content_type := req.Header.Get("Content-Type")
 	client := req.Header.Get("X-Mec-Client-ID")
 	vclock := req.Header.Get("X-Mec-Vclock")
+	returnbody := req.URL.Query().Get("returnbody") == "true"
 
-	b64, err := s.APIWrite(key, string(value), content_type, client, vclock)
+	maybe, b64, err := s.APIWrite(sp, key, string(value), content_type, client, vclock, returnbody)
 	if err != nil {
-		return err.Code, err.Error()
+		writeError(res, enc, err)
+		return
 	}
 
 	res.Header().Set("X-Mec-Vclock", b64)
-
-	return http.StatusOK, ""
+	if returnbody {
+		writeMaybe(res, req, maybe, b64)
+		return
+	}
+	res.WriteHeader(http.StatusOK)
 }
 
 func Delete(db *levigo.DB, params martini.Params, res http.ResponseWriter, req *http.Request) (int, string) {
 	return 501, ""
 }
-
-// MapEncoder intercepts the request's URL, detects the requested format,
-// and injects the correct encoder dependency for this request. It rewrites
-// the URL to remove the format extension, so that routes can be defined
-// without it.
-func MapEncoder(c martini.Context, res http.ResponseWriter, req *http.Request) {
-	// c.MapTo(jsonEncoder{}, (*Encoder)(nil))
-	// res.Header().Set("Content-Type", "application/json")
-}
@@ -1,59 +1,118 @@
 package apierrors
 
 import (
-	"fmt"
 	"errors"
+	"fmt"
+	"net/http"
 )
 
 const (
 	// Error codes (from http package, repeated for convenience)
 	// Deleted codes are ones we cannot hope to know when to return
 
-	StatusOK                      = 200 // GET
-	StatusNoContent               = 204 // PUT and POST
-	StatusMultipleChoices         = 300 // GET siblings
-	StatusBadRequest              = 400 // Malformed: no client id, etc
-	StatusNotFound                = 404 // GET non-existent key
-	StatusMethodNotAllowed        = 405 // 
-	StatusNotAcceptable           = 406 // Content-Type mismatch
-	StatusRequestTimeout          = 408 // Global timeout
-	StatusConflict                = 409 // Unable to resolve siblings into 300
-	StatusTeapot                  = 418 // Teapot is for any occasion
-	StatusInternalServerError     = 500 // Any other error, eg DB
-	StatusNotImplemented          = 501 // Stubs
-	StatusBadGateway              = 502 // All unspecified errors from upstream
-	StatusServiceUnavailable      = 503 // Server overload
-	StatusGatewayTimeout          = 504 // timed out on other nodes
+	StatusOK                  = 200 // GET
+	StatusNoContent           = 204 // PUT and POST
+	StatusMultipleChoices     = 300 // GET siblings
+	StatusBadRequest          = 400 // Malformed: no client id, etc
+	StatusUnauthorized        = 401 // No or bad credentials
+	StatusForbidden           = 403 // Permission denied
+	StatusNotFound            = 404 // GET non-existent key
+	StatusMethodNotAllowed    = 405 //
+	StatusNotAcceptable       = 406 // Content-Type mismatch
+	StatusRequestTimeout      = 408 // Global timeout
+	StatusConflict            = 409 // Unable to resolve siblings into 300
+	StatusTeapot              = 418 // Teapot is for any occasion
+	StatusInternalServerError = 500 // Any other error, eg DB
+	StatusNotImplemented      = 501 // Stubs
+	StatusBadGateway          = 502 // All unspecified errors from upstream
+	StatusServiceUnavailable  = 503 // Server overload
+	StatusGatewayTimeout      = 504 // timed out on other nodes
+)
+
+// Reasons: what went wrong, for programs. Unlike the messages these won't
+// change.
+const (
+	ReasonBadRequest       = "bad_request"
+	ReasonBadVClock        = "bad_vclock"
+	ReasonUnauthorized     = "unauthorized"
+	ReasonForbidden        = "forbidden"
+	ReasonNotFound         = "not_found"
+	ReasonConflict         = "conflict"
+	ReasonQuorumNotMet     = "quorum_not_met"
+	ReasonTimeout          = "timeout"
+	ReasonOverloaded       = "overloaded"
+	ReasonNotImplemented   = "not_implemented"
+	ReasonInternal         = "internal"
+	ReasonCommitIncomplete = "commit_incomplete" // a cluster commit some nodes didn't go along with
 )
 
-// The serializable Error structure.
+// The serializable Error structure. Code is the HTTP status.
 type Error struct {
 	error
-	Code int
+	Code      int
+	Reason    string
+	Retryable bool    // the same request may well work if tried again
+	Quorum    *Quorum // for reads and writes that didn't get enough replicas
+}
+
+// How far a read or write got towards its quorum
+type Quorum struct {
+	Op       string // read or write
+	Wanted   int
+	Achieved int
+	Failed   []string // replicas that didn't answer, or said no
+}
+
+// A Writer sends err to the client in the form it asked for. The API maps
+// one into each request, for middleware that can't encode errors itself.
+type Writer func(res http.ResponseWriter, err *Error)
+
+// reasons for each code, unless told otherwise
+var reasons = map[int]string{
+	StatusBadRequest:          ReasonBadRequest,
+	StatusUnauthorized:        ReasonUnauthorized,
+	StatusForbidden:           ReasonForbidden,
+	StatusNotFound:            ReasonNotFound,
+	StatusConflict:            ReasonConflict,
+	StatusInternalServerError: ReasonInternal,
+	StatusNotImplemented:      ReasonNotImplemented,
+	StatusBadGateway:          ReasonQuorumNotMet,
+	StatusServiceUnavailable:  ReasonOverloaded,
+	StatusGatewayTimeout:      ReasonTimeout,
+}
+
+func newError(code int, err error) *Error {
+	reason, ok := reasons[code]
+	if !ok {
+		reason = ReasonInternal
+	}
+	retryable := code == StatusBadGateway || code == StatusServiceUnavailable || code == StatusGatewayTimeout
+	return &Error{err, code, reason, retryable, nil}
 }
 
 // Codify augments an error instance with the specified code
 func Codify(code int, err error) *Error {
-	return &Error{
-		err,
-		code,
-	}
+	return newError(code, err)
 }
 
 // New creates a new Error instance with the code and message
 func NewError(code int, msg string) *Error {
-	return &Error{
-		errors.New(msg),
-		code,
-	}
+	return newError(code, errors.New(msg))
 }
 
 // New creates a new Error instance with the code and message
-func NewErrorFmt(code int, format string, msg ...interface {}) *Error {
-	mes := fmt.Sprintf(format, msg...)
-	return &Error{
-		errors.New(mes),
-		code,
-	}
+func NewErrorFmt(code int, format string, msg ...interface{}) *Error {
+	return newError(code, fmt.Errorf(format, msg...))
+}
+
+// Because sets the reason, for when the code's usual one isn't right
+func (e *Error) Because(reason string, retryable bool) *Error {
+	e.Reason, e.Retryable = reason, retryable
+	return e
 }
 
+// WithQuorum records how far a read or write got
+func (e *Error) WithQuorum(q Quorum) *Error {
+	e.Quorum = &q
+	return e
+}
@@ -0,0 +1,181 @@
+package api
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	apierrors "github.com/cormacrelf/mec-db/api/apierrors"
+	"github.com/cormacrelf/mec-db/auth"
+	"github.com/cormacrelf/mec-db/logging"
+	"github.com/cormacrelf/mec-db/metrics"
+	"github.com/cormacrelf/mec-db/store"
+	"github.com/cormacrelf/mec-db/trace"
+	"net/http"
+	"sync"
+)
+
+// BatchPath is where batches are posted. It shadows POST to a key named
+// _batch, which can still be written with PUT.
+const BatchPath = "/mec/_batch"
+
+const (
+	maxBatchOps   = 1000
+	maxBatchBytes = 32 << 20
+	// keys worked on at once for each batch
+	batchParallel = 32
+)
+
+var batchOps = metrics.NewCounterVec("mec_batch_ops_total",
+	"Operations run from batch requests, by type.", "op")
+
+// A BatchOp is one operation in a batch, as clients send them
+type BatchOp struct {
+	Op           string // get, put or delete
+	Key          string
+	Value        string
+	Base64       string `json:",omitempty"` // instead of Value, for values that aren't UTF-8
+	Content_Type string
+	Vclock       string
+	ReturnBody   bool // for puts, as ?returnbody=true
+}
+
+// A BatchResult is what became of a BatchOp. Code is the status it would
+// have had as a request of its own, so siblings are 300 and Multi.
+type BatchResult struct {
+	Op       string
+	Key      string
+	Code     int
+	Vclock   string     `json:",omitempty"`
+	Multi    bool       `json:",omitempty"`
+	Siblings []Sibling  `json:",omitempty"` // the value, or every sibling
+	Error    *errorBody `json:",omitempty"`
+}
+
+var batchPermissions = map[string]auth.Permission{
+	"get":    auth.Read,
+	"put":    auth.Write,
+	"delete": auth.Delete,
+}
+
+// Batch runs a JSON array of BatchOps and answers with a BatchResult for
+// each, in the same order. Operations on one key run one after another in
+// the order given; different keys run in parallel. Permissions are checked
+// for each operation, so one the user can't do fails on its own, and each
+// takes a slot from l as a request of its own would, failing with 503 if
+// there isn't one.
+func Batch(s *store.Store, rlog *logging.Logger, l Limiter, u *auth.User, sp *trace.Span, enc Encoder, res http.ResponseWriter, req *http.Request) (int, string) {
+	var ops []BatchOp
+	body := http.MaxBytesReader(res, req.Body, maxBatchBytes)
+	if err := json.NewDecoder(body).Decode(&ops); err != nil {
+		return respondError(res, enc, apierrors.NewErrorFmt(http.StatusBadRequest, "batch should be a JSON array of operations: %v", err))
+	}
+	if len(ops) > maxBatchOps {
+		return respondError(res, enc, apierrors.NewErrorFmt(http.StatusBadRequest, "batch has %d operations; the most allowed is %d", len(ops), maxBatchOps))
+	}
+	sp.Set("ops", len(ops))
+	results := runBatch(s.WithLog(rlog), l, u, sp, req.Header.Get("X-Mec-Client-ID"), ops)
+	return respond(res, enc, http.StatusOK, "batch", results)
+}
+
+// keyStore is what a batch, or a single read or write, needs of the store
+type keyStore interface {
+	APIRead(sp *trace.Span, key, client_id string) (store.MaybeMulti, string, *apierrors.Error)
+	APIWrite(sp *trace.Span, key, value, content_type, client_id, packed_vclock string, returnbody bool) (store.MaybeMulti, string, *apierrors.Error)
+}
+
+func runBatch(s keyStore, l Limiter, u *auth.User, sp *trace.Span, client string, ops []BatchOp) []BatchResult {
+	// indexes of each key's ops, keys in the order they first appear
+	var keys []string
+	byKey := make(map[string][]int)
+	for i, op := range ops {
+		if _, ok := byKey[op.Key]; !ok {
+			keys = append(keys, op.Key)
+		}
+		byKey[op.Key] = append(byKey[op.Key], i)
+	}
+
+	results := make([]BatchResult, len(ops))
+	running := make(chan struct{}, batchParallel)
+	var wg sync.WaitGroup
+	for _, key := range keys {
+		wg.Add(1)
+		running <- struct{}{}
+		go func(indexes []int) {
+			defer func() {
+				<-running
+				wg.Done()
+			}()
+			for _, i := range indexes {
+				results[i] = runBatchOp(s, l, u, sp, client, ops[i])
+			}
+		}(byKey[key])
+	}
+	wg.Wait()
+	return results
+}
+
+func runBatchOp(s keyStore, l Limiter, u *auth.User, sp *trace.Span, client string, op BatchOp) BatchResult {
+	r := BatchResult{Op: op.Op, Key: op.Key, Code: http.StatusOK}
+	fail := func(err *apierrors.Error) BatchResult {
+		body := newErrorBody(err)
+		r.Code, r.Error = err.Code, &body
+		return r
+	}
+
+	p, ok := batchPermissions[op.Op]
+	switch {
+	case !ok:
+		return fail(apierrors.NewErrorFmt(http.StatusBadRequest, "op %q should be get, put or delete", op.Op))
+	case op.Key == "":
+		return fail(apierrors.NewError(http.StatusBadRequest, "key is required"))
+	case !u.Can(p, op.Key):
+		return fail(apierrors.NewError(http.StatusForbidden, "forbidden"))
+	case !l.take():
+		return fail(errTooMany)
+	}
+	defer l.release()
+	batchOps.With(op.Op).Inc()
+
+	osp := sp.Child("batch "+op.Op, trace.Internal)
+	defer osp.End()
+	osp.Set("key", op.Key)
+
+	var (
+		maybe store.MaybeMulti
+		b64   string
+		err   *apierrors.Error
+	)
+	switch op.Op {
+	case "get":
+		maybe, b64, err = s.APIRead(osp, op.Key, client)
+	case "put":
+		value := op.Value
+		if op.Base64 != "" {
+			b, derr := base64.StdEncoding.DecodeString(op.Base64)
+			if derr != nil {
+				return fail(apierrors.NewError(http.StatusBadRequest, "Base64 isn't base64"))
+			}
+			value = string(b)
+		}
+		maybe, b64, err = s.APIWrite(osp, op.Key, value, op.Content_Type, client, op.Vclock, op.ReturnBody)
+	case "delete":
+		err = apierrors.NewError(http.StatusNotImplemented, "delete isn't implemented")
+	}
+	if err != nil {
+		osp.Fail(err.Error())
+		return fail(err)
+	}
+
+	r.Vclock = b64
+	if op.Op == "get" || op.ReturnBody {
+		rvs := maybe.Multiple
+		if !maybe.Multi {
+			rvs = []store.ReadValue{maybe.Single}
+		}
+		r.Multi = maybe.Multi
+		r.Siblings = envelope(rvs, b64).Siblings
+		if maybe.Multi {
+			r.Code = http.StatusMultipleChoices
+		}
+	}
+	return r
+}
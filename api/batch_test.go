@@ -0,0 +1,96 @@
+package api
+
+import (
+	apierrors "github.com/cormacrelf/mec-db/api/apierrors"
+	"github.com/cormacrelf/mec-db/auth"
+	"github.com/cormacrelf/mec-db/store"
+	"github.com/cormacrelf/mec-db/trace"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestBatchOpChecked(t *testing.T) {
+	for _, op := range []BatchOp{{Op: "list", Key: "a"}, {Op: "get"}} {
+		r := runBatchOp(nil, NewLimiter(1), auth.Anonymous, nil, "", op)
+		if r.Code != http.StatusBadRequest || r.Error == nil || r.Error.Reason != "bad_request" {
+			t.Errorf("%+v: got %+v", op, r)
+		}
+	}
+}
+
+func TestBatchNotAnArray(t *testing.T) {
+	req, _ := http.NewRequest("POST", BatchPath, strings.NewReader(`{"Op":"get","Key":"a"}`))
+	res := httptest.NewRecorder()
+	code, body := Batch(nil, nil, NewLimiter(1), auth.Anonymous, nil, jsonEncoder{}, res, req)
+	if code != http.StatusBadRequest || !strings.Contains(body, `"Reason":"bad_request"`) {
+		t.Errorf("got %d %s", code, body)
+	}
+}
+
+// memStore keeps the last value written to each key, taking a little while
+// about it so that keys run in parallel get mixed up
+type memStore struct {
+	sync.Mutex
+	m map[string]string
+}
+
+func (m *memStore) APIRead(sp *trace.Span, key, client_id string) (store.MaybeMulti, string, *apierrors.Error) {
+	time.Sleep(time.Duration(rand.Intn(100)) * time.Microsecond)
+	m.Lock()
+	defer m.Unlock()
+	v, ok := m.m[key]
+	if !ok {
+		return store.MaybeMulti{}, "", apierrors.NewError(http.StatusNotFound, "no successful reads")
+	}
+	return store.MaybeMulti{Single: store.ReadValue{Value: v, Content_Type: "text/plain"}}, "", nil
+}
+
+func (m *memStore) APIWrite(sp *trace.Span, key, value, content_type, client_id, packed_vclock string, returnbody bool) (store.MaybeMulti, string, *apierrors.Error) {
+	time.Sleep(time.Duration(rand.Intn(100)) * time.Microsecond)
+	m.Lock()
+	defer m.Unlock()
+	m.m[key] = value
+	return store.MaybeMulti{}, "", nil
+}
+
+func TestBatchKeepsOrderWithinKeys(t *testing.T) {
+	s := &memStore{m: make(map[string]string)}
+	var ops []BatchOp
+	keys := []string{"lion", "gazelle", "zebra", "hyena", "vulture"}
+	for i := 0; i < 20; i++ {
+		for _, k := range keys {
+			ops = append(ops, BatchOp{Op: "put", Key: k, Value: strconv.Itoa(i)},
+				BatchOp{Op: "get", Key: k})
+		}
+	}
+
+	results := runBatch(s, NewLimiter(len(keys)), auth.Anonymous, nil, "", ops)
+	if len(results) != len(ops) {
+		t.Fatalf("%d results for %d ops", len(results), len(ops))
+	}
+	for i, r := range results {
+		op := ops[i]
+		if r.Op != op.Op || r.Key != op.Key || r.Code != http.StatusOK {
+			t.Fatalf("result %d is %+v for %+v", i, r, op)
+		}
+		// each get sees the put just before it
+		if op.Op == "get" && (len(r.Siblings) != 1 || r.Siblings[0].Value != ops[i-1].Value) {
+			t.Errorf("get of %s after putting %s got %+v", op.Key, ops[i-1].Value, r.Siblings)
+		}
+	}
+}
+
+func TestBatchOpsTakeSlots(t *testing.T) {
+	l := NewLimiter(1)
+	l.take()
+	r := runBatchOp(&memStore{m: make(map[string]string)}, l, auth.Anonymous, nil, "", BatchOp{Op: "put", Key: "a"})
+	if r.Code != http.StatusServiceUnavailable || r.Error == nil || !r.Error.Retryable {
+		t.Errorf("a put with no slot free got %+v", r)
+	}
+}
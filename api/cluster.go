@@ -0,0 +1,69 @@
+package api
+
+import (
+	apierrors "github.com/cormacrelf/mec-db/api/apierrors"
+	"github.com/cormacrelf/mec-db/cluster"
+	"net/http"
+)
+
+// /admin/cluster endpoints, as used by mec-admin
+
+// GetCluster lists every member with its health and share of the key space
+func GetCluster(c *cluster.Claimant, enc Encoder, res http.ResponseWriter) (int, string) {
+	return respond(res, enc, http.StatusOK, "cluster", c.Status())
+}
+
+// JoinCluster makes this node join the cluster that ?addr= (host:port of any
+// member's gossip port) is in. It waits outside the ring for a commit.
+func JoinCluster(c *cluster.Claimant, enc Encoder, res http.ResponseWriter, req *http.Request) (int, string) {
+	addr := req.FormValue("addr")
+	if addr == "" {
+		return respondError(res, enc, apierrors.NewError(http.StatusBadRequest, "addr is required"))
+	}
+	if err := c.Join(addr); err != nil {
+		return respondError(res, enc, apierrors.NewError(http.StatusConflict, err.Error()))
+	}
+	return respond(res, enc, http.StatusOK, "cluster", c.Status())
+}
+
+// StageLeave stages ?node= leaving the cluster
+func StageLeave(c *cluster.Claimant, enc Encoder, res http.ResponseWriter, req *http.Request) (int, string) {
+	return stage(c, enc, res, cluster.Change{Action: "leave", Node: req.FormValue("node")})
+}
+
+// StageReplace stages ?node= handing its partitions to ?with=, which must
+// have joined already
+func StageReplace(c *cluster.Claimant, enc Encoder, res http.ResponseWriter, req *http.Request) (int, string) {
+	return stage(c, enc, res, cluster.Change{Action: "replace", Node: req.FormValue("node"), With: req.FormValue("with")})
+}
+
+func stage(c *cluster.Claimant, enc Encoder, res http.ResponseWriter, ch cluster.Change) (int, string) {
+	if err := c.Stage(ch); err != nil {
+		return respondError(res, enc, apierrors.NewError(http.StatusConflict, err.Error()))
+	}
+	return respond(res, enc, http.StatusOK, "plan", c.Plan())
+}
+
+// GetPlan shows the staged changes and the partition transfers they need
+func GetPlan(c *cluster.Claimant, enc Encoder, res http.ResponseWriter) (int, string) {
+	return respond(res, enc, http.StatusOK, "plan", c.Plan())
+}
+
+// ClearPlan throws away the staged changes
+func ClearPlan(c *cluster.Claimant, enc Encoder, res http.ResponseWriter) (int, string) {
+	c.Clear()
+	return respond(res, enc, http.StatusOK, "plan", c.Plan())
+}
+
+// CommitPlan carries out the plan. When some nodes don't go along with it
+// their changes stay staged, so committing again is worth a try.
+func CommitPlan(c *cluster.Claimant, enc Encoder, res http.ResponseWriter) (int, string) {
+	plan, err := c.Commit()
+	switch {
+	case err == cluster.ErrNothingStaged:
+		return respondError(res, enc, apierrors.NewError(http.StatusConflict, err.Error()))
+	case err != nil:
+		return respondError(res, enc, apierrors.NewError(http.StatusBadGateway, err.Error()).Because(apierrors.ReasonCommitIncomplete, true))
+	}
+	return respond(res, enc, http.StatusOK, "plan", plan)
+}
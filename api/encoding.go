@@ -0,0 +1,293 @@
+/*
+Copyright (c) 2013, Martin Angers
+All rights reserved.
+
+Redistribution and use in source and binary forms, with or without modification, are permitted provided that the following conditions are met:
+
+* Redistributions of source code must retain the above copyright notice, this list of conditions and the following disclaimer.
+
+* Redistributions in binary form must reproduce the above copyright notice, this list of conditions and the following disclaimer in the documentation and/or other materials provided with the distribution.
+
+* Neither the name of the author nor the names of its contributors may be used to endorse or promote products derived from this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package api
+
+import (
+	"bytes"
+	"encoding"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"github.com/codegangsta/martini"
+	apierrors "github.com/cormacrelf/mec-db/api/apierrors"
+	"net/http"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// An Encoder implements an encoding format of values to be sent as response to
+// requests on the API endpoints.
+type Encoder interface {
+	ContentType() string
+	// Encode v. root names the outermost element, for formats that have one.
+	Encode(root string, v interface{}) ([]byte, error)
+}
+
+type jsonEncoder struct{}
+
+// jsonEncoder is an Encoder that produces JSON-formatted responses.
+func (_ jsonEncoder) ContentType() string { return "application/json" }
+
+func (_ jsonEncoder) Encode(root string, v interface{}) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+type xmlEncoder struct{}
+
+// xmlEncoder is an Encoder that produces XML-formatted responses. Struct
+// fields become elements named as in the JSON, map entries become <entry
+// key="..."> and list items become <item>, so maps and slices encode too.
+func (_ xmlEncoder) ContentType() string { return "application/xml" }
+
+func (_ xmlEncoder) Encode(root string, v interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	buf.WriteString(xml.Header)
+	if err := writeXML(&buf, root, "", reflect.ValueOf(v)); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+var textMarshaler = reflect.TypeOf((*encoding.TextMarshaler)(nil)).Elem()
+
+func writeXML(buf *bytes.Buffer, name, key string, v reflect.Value) error {
+	for v.IsValid() && (v.Kind() == reflect.Ptr || v.Kind() == reflect.Interface) && !v.Type().Implements(textMarshaler) {
+		v = v.Elem()
+	}
+	buf.WriteString("<" + name)
+	if key != "" {
+		buf.WriteString(` key="`)
+		xml.EscapeText(buf, []byte(key))
+		buf.WriteString(`"`)
+	}
+	if !v.IsValid() || ((v.Kind() == reflect.Ptr || v.Kind() == reflect.Interface) && v.IsNil()) {
+		buf.WriteString("/>")
+		return nil
+	}
+	buf.WriteString(">")
+
+	switch {
+	case v.Type().Implements(textMarshaler):
+		text, err := v.Interface().(encoding.TextMarshaler).MarshalText()
+		if err != nil {
+			return err
+		}
+		xml.EscapeText(buf, text)
+	case v.Kind() == reflect.Struct:
+		if err := writeFields(buf, v); err != nil {
+			return err
+		}
+	case v.Kind() == reflect.Map:
+		keys := make([]string, 0, v.Len())
+		byKey := make(map[string]reflect.Value, v.Len())
+		for _, k := range v.MapKeys() {
+			ks := fmt.Sprint(k.Interface())
+			keys = append(keys, ks)
+			byKey[ks] = v.MapIndex(k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			if err := writeXML(buf, "entry", k, byKey[k]); err != nil {
+				return err
+			}
+		}
+	case v.Kind() == reflect.Slice && v.Type().Elem().Kind() == reflect.Uint8:
+		buf.WriteString(base64.StdEncoding.EncodeToString(v.Bytes()))
+	case v.Kind() == reflect.Slice || v.Kind() == reflect.Array:
+		for i := 0; i < v.Len(); i++ {
+			if err := writeXML(buf, "item", "", v.Index(i)); err != nil {
+				return err
+			}
+		}
+	default:
+		xml.EscapeText(buf, []byte(fmt.Sprint(v.Interface())))
+	}
+
+	buf.WriteString("</" + name + ">")
+	return nil
+}
+
+// writeFields writes a struct's exported fields, skipping what the JSON
+// would skip
+func writeFields(buf *bytes.Buffer, v reflect.Value) error {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if f.PkgPath != "" {
+			continue
+		}
+		name, omitempty := f.Name, false
+		if tag := f.Tag.Get("json"); tag != "" {
+			parts := strings.Split(tag, ",")
+			if parts[0] == "-" {
+				continue
+			}
+			if parts[0] != "" {
+				name = parts[0]
+			}
+			for _, p := range parts[1:] {
+				omitempty = omitempty || p == "omitempty"
+			}
+		}
+		fv := v.Field(i)
+		if omitempty && isEmpty(fv) {
+			continue
+		}
+		if f.Anonymous && fv.Kind() == reflect.Struct {
+			if err := writeFields(buf, fv); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := writeXML(buf, name, "", fv); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func isEmpty(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.Slice, reflect.Map, reflect.String, reflect.Array:
+		return v.Len() == 0
+	case reflect.Ptr, reflect.Interface:
+		return v.IsNil()
+	case reflect.Struct:
+		return false
+	}
+	return v.IsValid() && v.Interface() == reflect.Zero(v.Type()).Interface()
+}
+
+// What a client can ask for, in its Accept header or with a suffix
+var (
+	encoders = map[string]Encoder{
+		"application/json": jsonEncoder{},
+		"application/xml":  xmlEncoder{},
+		"text/xml":         xmlEncoder{},
+	}
+	suffixes = map[string]Encoder{
+		".json": jsonEncoder{},
+		".xml":  xmlEncoder{},
+	}
+)
+
+// accepts picks whichever of types the request's Accept header prefers,
+// by q-value and then by the order they're listed in, or "" if it accepts
+// none of them. Wildcards don't count: a client that will take anything
+// gets the plainest answer.
+func accepts(req *http.Request, types ...string) string {
+	best, bestQ := "", 0.0
+	for _, part := range strings.Split(req.Header.Get("Accept"), ",") {
+		params := strings.Split(part, ";")
+		mt := strings.ToLower(strings.TrimSpace(params[0]))
+		q := 1.0
+		for _, param := range params[1:] {
+			kv := strings.SplitN(strings.TrimSpace(param), "=", 2)
+			if len(kv) == 2 && strings.TrimSpace(kv[0]) == "q" {
+				if f, err := strconv.ParseFloat(strings.TrimSpace(kv[1]), 64); err == nil {
+					q = f
+				}
+			}
+		}
+		if q <= bestQ {
+			continue
+		}
+		for _, t := range types {
+			if mt == t {
+				best, bestQ = t, q
+			}
+		}
+	}
+	return best
+}
+
+// MapEncoder intercepts the request's URL, detects the requested format,
+// and injects the correct encoder dependency for this request. It rewrites
+// the URL to remove the format extension, so that routes can be defined
+// without it.
+func MapEncoder(c martini.Context, res http.ResponseWriter, req *http.Request) {
+	enc := negotiate(req)
+	c.MapTo(enc, (*Encoder)(nil))
+	c.Map(errorWriter(enc))
+}
+
+// negotiate picks an Encoder by the URL's suffix, then the Accept header,
+// then JSON. Keys can end in anything, so under /mec/ only Accept counts.
+func negotiate(req *http.Request) Encoder {
+	if !strings.HasPrefix(req.URL.Path, "/mec/") {
+		for suffix, enc := range suffixes {
+			if strings.HasSuffix(req.URL.Path, suffix) {
+				req.URL.Path = strings.TrimSuffix(req.URL.Path, suffix)
+				return enc
+			}
+		}
+	}
+	if t := accepts(req, "application/json", "application/xml", "text/xml"); t != "" {
+		return encoders[t]
+	}
+	return jsonEncoder{}
+}
+
+// respond encodes v as the client asked, the outermost XML element named
+// root, for handlers returning (int, string)
+func respond(res http.ResponseWriter, enc Encoder, code int, root string, v interface{}) (int, string) {
+	b, err := enc.Encode(root, v)
+	if err != nil {
+		return http.StatusInternalServerError, err.Error()
+	}
+	res.Header().Set("Content-Type", enc.ContentType())
+	return code, string(b)
+}
+
+// An error as clients see it. Programs should go by Reason and Retryable;
+// Error is for people.
+type errorBody struct {
+	Code      int
+	Reason    string
+	Error     string
+	Retryable bool
+	Quorum    *apierrors.Quorum `json:",omitempty"`
+}
+
+func newErrorBody(err *apierrors.Error) errorBody {
+	return errorBody{err.Code, err.Reason, err.Error(), err.Retryable, err.Quorum}
+}
+
+func respondError(res http.ResponseWriter, enc Encoder, err *apierrors.Error) (int, string) {
+	return respond(res, enc, err.Code, "error", newErrorBody(err))
+}
+
+// writeError is respondError for handlers that write their own response
+func writeError(res http.ResponseWriter, enc Encoder, err *apierrors.Error) {
+	code, body := respondError(res, enc, err)
+	res.WriteHeader(code)
+	res.Write([]byte(body))
+}
+
+func errorWriter(enc Encoder) apierrors.Writer {
+	return func(res http.ResponseWriter, err *apierrors.Error) {
+		writeError(res, enc, err)
+	}
+}
+
+// WriteError is writeError for plain http handlers, in the format req asks
+// for
+func WriteError(res http.ResponseWriter, req *http.Request, err *apierrors.Error) {
+	writeError(res, negotiate(req), err)
+}
@@ -0,0 +1,94 @@
+package api
+
+import (
+	apierrors "github.com/cormacrelf/mec-db/api/apierrors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestNegotiate(t *testing.T) {
+	cases := []struct {
+		path, accept string
+		want         Encoder
+		rewritten    string
+	}{
+		{"/stats", "", jsonEncoder{}, "/stats"},
+		{"/stats", "text/html, application/xml;q=0.9", xmlEncoder{}, "/stats"},
+		{"/stats.xml", "application/json", xmlEncoder{}, "/stats"},
+		{"/admin/peers.json", "", jsonEncoder{}, "/admin/peers"},
+		{"/mec/report.xml", "", jsonEncoder{}, "/mec/report.xml"},
+		{"/mec/report.xml", "text/xml", xmlEncoder{}, "/mec/report.xml"},
+		{"/stats", "application/json;q=0.5, application/xml", xmlEncoder{}, "/stats"},
+		{"/stats", "application/xml;q=0, application/json;q=0.1", jsonEncoder{}, "/stats"},
+		{"/stats", "application/xml;q=0", jsonEncoder{}, "/stats"},
+	}
+	for _, c := range cases {
+		req, _ := http.NewRequest("GET", c.path, nil)
+		req.Header.Set("Accept", c.accept)
+		if got := negotiate(req); got != c.want {
+			t.Errorf("%s with Accept %q: got %T", c.path, c.accept, got)
+		}
+		if req.URL.Path != c.rewritten {
+			t.Errorf("%s: rewritten to %s", c.path, req.URL.Path)
+		}
+	}
+}
+
+func TestXMLEncoder(t *testing.T) {
+	v := struct {
+		Node    string
+		Started time.Time
+		Peers   map[string]string
+		Owned   []int
+		Error   string `json:",omitempty"`
+		Skipped string `json:"-"`
+	}{
+		Node:    "a&b",
+		Started: time.Date(2014, 1, 18, 10, 49, 23, 0, time.UTC),
+		Peers:   map[string]string{"z": "tcp://z:7000", "a": "tcp://a:7000"},
+		Owned:   []int{1, 2},
+	}
+	b, err := xmlEncoder{}.Encode("stats", v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `<?xml version="1.0" encoding="UTF-8"?>
+<stats><Node>a&amp;b</Node><Started>2014-01-18T10:49:23Z</Started>` +
+		`<Peers><entry key="a">tcp://a:7000</entry><entry key="z">tcp://z:7000</entry></Peers>` +
+		`<Owned><item>1</item><item>2</item></Owned></stats>`
+	if string(b) != want {
+		t.Errorf("got  %s\nwant %s", b, want)
+	}
+}
+
+func TestErrorBody(t *testing.T) {
+	err := apierrors.NewError(http.StatusGatewayTimeout, "only 1 of 2 replicas answered").
+		WithQuorum(apierrors.Quorum{Op: "read", Wanted: 2, Achieved: 1, Failed: []string{"b"}})
+	res := httptest.NewRecorder()
+	code, body := respondError(res, jsonEncoder{}, err)
+	want := `{"Code":504,"Reason":"timeout","Error":"only 1 of 2 replicas answered","Retryable":true,` +
+		`"Quorum":{"Op":"read","Wanted":2,"Achieved":1,"Failed":["b"]}}`
+	if code != http.StatusGatewayTimeout || body != want {
+		t.Errorf("got %d %s", code, body)
+	}
+
+	_, body = respondError(res, jsonEncoder{}, apierrors.NewError(http.StatusNotFound, "no successful reads"))
+	if want := `{"Code":404,"Reason":"not_found","Error":"no successful reads","Retryable":false}`; body != want {
+		t.Errorf("got %s", body)
+	}
+}
+
+func TestErrorWriter(t *testing.T) {
+	res := httptest.NewRecorder()
+	errorWriter(xmlEncoder{})(res, apierrors.NewError(apierrors.StatusUnauthorized, "unauthorized"))
+	want := `<?xml version="1.0" encoding="UTF-8"?>
+<error><Code>401</Code><Reason>unauthorized</Reason><Error>unauthorized</Error><Retryable>false</Retryable></error>`
+	if res.Code != http.StatusUnauthorized || res.Body.String() != want {
+		t.Errorf("got %d %s", res.Code, res.Body)
+	}
+	if ct := res.Header().Get("Content-Type"); ct != "application/xml" {
+		t.Errorf("Content-Type %s", ct)
+	}
+}
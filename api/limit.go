@@ -0,0 +1,63 @@
+package api
+
+import (
+	"github.com/codegangsta/martini"
+	apierrors "github.com/cormacrelf/mec-db/api/apierrors"
+	"github.com/cormacrelf/mec-db/metrics"
+	"net/http"
+	"strings"
+)
+
+var rejected = metrics.NewCounter("mec_http_rejected_total",
+	"Key requests refused with 503 because too many were already running.")
+
+// A Limiter lets at most so many key operations run at once
+type Limiter chan struct{}
+
+func NewLimiter(n int) Limiter {
+	return make(Limiter, n)
+}
+
+// take claims a slot for one operation, or returns false straight away if
+// there are none; release gives it back.
+func (l Limiter) take() bool {
+	select {
+	case l <- struct{}{}:
+		return true
+	default:
+		rejected.Inc()
+		return false
+	}
+}
+
+func (l Limiter) release() {
+	<-l
+}
+
+var errTooMany = apierrors.NewError(http.StatusServiceUnavailable, "too many requests in progress")
+
+// Limit is martini middleware that lets at most l's worth of key requests
+// (/mec/...) run at once and turns the rest away with 503 straight away, so
+// a busy node sheds load instead of queueing it. A batch isn't limited
+// here, as it takes its slots one operation at a time, see Batch. Admin
+// requests aren't limited, so an overloaded node can still be looked at.
+func Limit(l Limiter) martini.Handler {
+	return func(c martini.Context, enc Encoder, res http.ResponseWriter, req *http.Request) {
+		if !limited(req.URL.Path) {
+			return
+		}
+		if !l.take() {
+			res.Header().Set("Retry-After", "1")
+			writeError(res, enc, errTooMany)
+			return
+		}
+		defer l.release()
+		c.Next()
+	}
+}
+
+// limited says whether requests for path count towards the limit: keys
+// do, but not GET /mec, which is the admin stats
+func limited(path string) bool {
+	return strings.HasPrefix(path, "/mec/") && path != BatchPath
+}
@@ -0,0 +1,17 @@
+package api
+
+import "testing"
+
+func TestLimited(t *testing.T) {
+	for path, want := range map[string]bool{
+		"/mec/album":   true,
+		"/mec/_batch":  false, // its ops take slots of their own
+		"/admin/peers": false,
+		"/stats":       false,
+		"/mec":         false,
+	} {
+		if got := limited(path); got != want {
+			t.Errorf("%s: limited is %v", path, got)
+		}
+	}
+}
@@ -0,0 +1,137 @@
+package api
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"github.com/cormacrelf/mec-db/store"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// How a 300 Multiple Choices can describe siblings, besides the envelope
+// any Encoder can give, depending on Accept
+const (
+	siblingList      = "text/plain"
+	siblingMultipart = "multipart/mixed"
+)
+
+func etag(rv store.ReadValue) string {
+	return `"` + rv.Vtag + `"`
+}
+
+// valueHeader describes a value, for a response or a part of one
+func valueHeader(h http.Header, rv store.ReadValue) {
+	h.Set("Content-Type", rv.Content_Type)
+	t := time.Unix(0, rv.Timestamp)
+	h.Set("Last-Modified", t.UTC().Format(http.TimeFormat))
+	h.Set("X-Mec-Timestamp", fmt.Sprintf("%d", rv.Timestamp))
+	h.Set("X-Mec-Vtag", rv.Vtag)
+	h.Set("Etag", etag(rv))
+}
+
+func writeValue(res http.ResponseWriter, rv store.ReadValue) {
+	valueHeader(res.Header(), rv)
+	res.WriteHeader(http.StatusOK)
+	res.Write([]byte(rv.Value))
+}
+
+// writeMaybe writes a value, or its siblings as 300 Multiple Choices: every
+// sibling as multipart/mixed or in a JSON or XML envelope if the client
+// accepts one, otherwise their vtags, to fetch the ones it wants with ?vtag=
+func writeMaybe(res http.ResponseWriter, req *http.Request, maybe store.MaybeMulti, b64 string) {
+	if !maybe.Multi {
+		writeValue(res, maybe.Single)
+		return
+	}
+
+	vtags := make([]string, len(maybe.Multiple))
+	for i, rv := range maybe.Multiple {
+		vtags[i] = rv.Vtag
+	}
+	res.Header().Set("X-Mec-Siblings", strings.Join(vtags, ", "))
+
+	var (
+		body []byte
+		ct   string
+		err  error
+	)
+	switch t := accepts(req, siblingMultipart, "application/json", "application/xml", "text/xml"); t {
+	case siblingMultipart:
+		body, ct, err = multipartSiblings(maybe.Multiple)
+	case "":
+		body = []byte("Siblings:\n" + strings.Join(vtags, "\n") + "\n")
+		ct = siblingList
+	default:
+		enc := encoders[t]
+		body, err = enc.Encode("siblings", envelope(maybe.Multiple, b64))
+		ct = enc.ContentType()
+	}
+	if err != nil {
+		res.WriteHeader(http.StatusInternalServerError)
+		res.Write([]byte(err.Error()))
+		return
+	}
+	res.Header().Set("Content-Type", ct)
+	res.WriteHeader(http.StatusMultipleChoices) // 300
+	res.Write(body)
+}
+
+// multipartSiblings gives every sibling a part of its own, and the
+// Content-Type naming the boundary between them
+func multipartSiblings(rvs []store.ReadValue) ([]byte, string, error) {
+	body := &bytes.Buffer{}
+	writer := multipart.NewWriter(body)
+	for _, rv := range rvs {
+		header := make(textproto.MIMEHeader)
+		valueHeader(http.Header(header), rv)
+		part, err := writer.CreatePart(header)
+		if err != nil {
+			return nil, "", err
+		}
+		part.Write([]byte(rv.Value))
+	}
+	if err := writer.Close(); err != nil {
+		return nil, "", err
+	}
+	return body.Bytes(), siblingMultipart + "; boundary=" + writer.Boundary(), nil
+}
+
+// The envelope form of siblings. A value that isn't UTF-8 comes as
+// Base64 instead of Value.
+type Siblings struct {
+	Vclock   string
+	Siblings []Sibling
+}
+
+type Sibling struct {
+	Vtag          string
+	Content_Type  string
+	Last_Modified string
+	Timestamp     int64
+	Value         string
+	Base64        string `json:",omitempty"`
+}
+
+func envelope(rvs []store.ReadValue, b64 string) Siblings {
+	sibs := Siblings{b64, make([]Sibling, len(rvs))}
+	for i, rv := range rvs {
+		sib := Sibling{
+			Vtag:          rv.Vtag,
+			Content_Type:  rv.Content_Type,
+			Last_Modified: time.Unix(0, rv.Timestamp).UTC().Format(http.TimeFormat),
+			Timestamp:     rv.Timestamp,
+		}
+		if utf8.ValidString(rv.Value) {
+			sib.Value = rv.Value
+		} else {
+			sib.Base64 = base64.StdEncoding.EncodeToString([]byte(rv.Value))
+		}
+		sibs.Siblings[i] = sib
+	}
+	return sibs
+}
@@ -0,0 +1,182 @@
+package api
+
+import (
+	"encoding/json"
+	apierrors "github.com/cormacrelf/mec-db/api/apierrors"
+	"github.com/cormacrelf/mec-db/store"
+	"github.com/cormacrelf/mec-db/trace"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+var twoSiblings = store.MaybeMulti{Multi: true, Multiple: []store.ReadValue{
+	{Value: "version 2", Content_Type: "text/plain", Timestamp: 1390002556455363523, Vtag: "2fd4e1c67a2d28fc"},
+	{Value: "\xff\xfe", Content_Type: "application/octet-stream", Timestamp: 1390002508437355039, Vtag: "e4d909c290d0fb1c"},
+}}
+
+func siblingsAs(accept string) *httptest.ResponseRecorder {
+	req, _ := http.NewRequest("GET", "/mec/album", nil)
+	req.Header.Set("Accept", accept)
+	res := httptest.NewRecorder()
+	writeMaybe(res, req, twoSiblings, "vclock")
+	return res
+}
+
+func TestMultipartSiblings(t *testing.T) {
+	res := siblingsAs("multipart/mixed")
+	if res.Code != http.StatusMultipleChoices {
+		t.Fatalf("got %d, want 300", res.Code)
+	}
+	mt, params, err := mime.ParseMediaType(res.Header().Get("Content-Type"))
+	if err != nil || mt != "multipart/mixed" || params["boundary"] == "" {
+		t.Fatalf("bad Content-Type %q", res.Header().Get("Content-Type"))
+	}
+
+	r := multipart.NewReader(res.Body, params["boundary"])
+	for i, want := range twoSiblings.Multiple {
+		part, err := r.NextPart()
+		if err != nil {
+			t.Fatalf("part %d: %v", i, err)
+		}
+		body, _ := ioutil.ReadAll(part)
+		if string(body) != want.Value {
+			t.Errorf("part %d is %q, want %q", i, body, want.Value)
+		}
+		if ct := part.Header.Get("Content-Type"); ct != want.Content_Type {
+			t.Errorf("part %d has Content-Type %q", i, ct)
+		}
+		if etag := part.Header.Get("Etag"); etag != `"`+want.Vtag+`"` {
+			t.Errorf("part %d has Etag %q", i, etag)
+		}
+	}
+	if _, err := r.NextPart(); err == nil {
+		t.Error("more parts than siblings")
+	}
+}
+
+func TestJSONSiblings(t *testing.T) {
+	res := siblingsAs("application/json, multipart/mixed;q=0.5")
+	if ct := res.Header().Get("Content-Type"); ct != "application/json" {
+		t.Fatalf("got Content-Type %q", ct)
+	}
+	var sibs Siblings
+	if err := json.Unmarshal(res.Body.Bytes(), &sibs); err != nil {
+		t.Fatal(err)
+	}
+	if sibs.Vclock != "vclock" || len(sibs.Siblings) != 2 {
+		t.Fatalf("got %+v", sibs)
+	}
+	if sibs.Siblings[0].Value != "version 2" {
+		t.Errorf("got value %q", sibs.Siblings[0].Value)
+	}
+	if sibs.Siblings[1].Base64 != "//4=" {
+		t.Errorf("binary value should be base64, got %+v", sibs.Siblings[1])
+	}
+}
+
+func TestSiblingsByQuality(t *testing.T) {
+	for accept, want := range map[string]string{
+		"multipart/mixed;q=0.1, application/json":       "application/json",
+		"application/json;q=0.2, multipart/mixed;q=0.8": "multipart/mixed",
+		"application/xml, multipart/mixed;q=1.0":        "application/xml",
+		"MULTIPART/MIXED, application/json;q=0.9":       "multipart/mixed",
+		"multipart/mixed;q=0, text/html":                siblingList,
+	} {
+		ct := siblingsAs(accept).Header().Get("Content-Type")
+		if !strings.HasPrefix(ct, want) {
+			t.Errorf("Accept %q got %q, want %s", accept, ct, want)
+		}
+	}
+}
+
+func TestXMLSiblings(t *testing.T) {
+	res := siblingsAs("application/xml")
+	want := `<?xml version="1.0" encoding="UTF-8"?>
+<siblings><Vclock>vclock</Vclock><Siblings><item><Vtag>2fd4e1c67a2d28fc</Vtag>`
+	if got := res.Body.String(); !strings.HasPrefix(got, want) {
+		t.Errorf("got %s", got)
+	}
+}
+
+func TestSiblingList(t *testing.T) {
+	res := siblingsAs("")
+	if got := res.Header().Get("X-Mec-Siblings"); got != "2fd4e1c67a2d28fc, e4d909c290d0fb1c" {
+		t.Errorf("X-Mec-Siblings is %q", got)
+	}
+	if got := res.Body.String(); got != "Siblings:\n2fd4e1c67a2d28fc\ne4d909c290d0fb1c\n" {
+		t.Errorf("body is %q", got)
+	}
+}
+
+// fixedStore answers every read and write with the same thing
+type fixedStore store.MaybeMulti
+
+func (f fixedStore) APIRead(sp *trace.Span, key, client_id string) (store.MaybeMulti, string, *apierrors.Error) {
+	return store.MaybeMulti(f), "vclock", nil
+}
+
+func (f fixedStore) APIWrite(sp *trace.Span, key, value, content_type, client_id, packed_vclock string, returnbody bool) (store.MaybeMulti, string, *apierrors.Error) {
+	if !returnbody {
+		return store.MaybeMulti{}, "vclock", nil
+	}
+	return store.MaybeMulti(f), "vclock", nil
+}
+
+func TestPutReturnBody(t *testing.T) {
+	write := func(s keyStore, url string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest("PUT", url, strings.NewReader("version 3"))
+		req.Header.Set("Accept", "application/json")
+		res := httptest.NewRecorder()
+		put(s, nil, jsonEncoder{}, "album", res, req)
+		return res
+	}
+
+	res := write(fixedStore(twoSiblings), "/mec/album?returnbody=true")
+	var sibs Siblings
+	if res.Code != http.StatusMultipleChoices || json.Unmarshal(res.Body.Bytes(), &sibs) != nil || len(sibs.Siblings) != 2 {
+		t.Errorf("siblings after a write: got %d %s", res.Code, res.Body)
+	}
+	if got := res.Header().Get("X-Mec-Vclock"); got != "vclock" {
+		t.Errorf("X-Mec-Vclock is %q", got)
+	}
+
+	one := store.MaybeMulti{Single: twoSiblings.Multiple[0]}
+	res = write(fixedStore(one), "/mec/album?returnbody=true")
+	if res.Code != http.StatusOK || res.Body.String() != "version 2" || res.Header().Get("X-Mec-Vtag") != "2fd4e1c67a2d28fc" {
+		t.Errorf("one value after a write: got %d %q %v", res.Code, res.Body, res.Header())
+	}
+
+	res = write(fixedStore(twoSiblings), "/mec/album")
+	if res.Code != http.StatusOK || res.Body.Len() != 0 {
+		t.Errorf("without returnbody: got %d %q", res.Code, res.Body)
+	}
+}
+
+func TestGetVtag(t *testing.T) {
+	read := func(url string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest("GET", url, nil)
+		res := httptest.NewRecorder()
+		get(fixedStore(twoSiblings), nil, jsonEncoder{}, "album", res, req)
+		return res
+	}
+
+	for _, want := range twoSiblings.Multiple {
+		res := read("/mec/album?vtag=" + want.Vtag)
+		if res.Code != http.StatusOK || res.Body.String() != want.Value || res.Header().Get("X-Mec-Vtag") != want.Vtag {
+			t.Errorf("vtag %s: got %d %q", want.Vtag, res.Code, res.Body)
+		}
+		if got := res.Header().Get("X-Mec-Vclock"); got != "vclock" {
+			t.Errorf("vtag %s: X-Mec-Vclock is %q", want.Vtag, got)
+		}
+	}
+
+	res := read("/mec/album?vtag=0123456789abcdef")
+	if res.Code != http.StatusNotFound || !strings.Contains(res.Body.String(), `"Reason":"not_found"`) {
+		t.Errorf("unknown vtag: got %d %s", res.Code, res.Body)
+	}
+}
@@ -0,0 +1,81 @@
+package api
+
+import (
+	"github.com/cormacrelf/mec-db/metrics"
+	"github.com/cormacrelf/mec-db/peers"
+	"github.com/cormacrelf/mec-db/store"
+	ml "github.com/hashicorp/memberlist"
+	"net/http"
+	"sort"
+	"time"
+)
+
+// NodeInfo is what main knows about this node
+type NodeInfo struct {
+	Name    string
+	Version string
+	Started time.Time
+}
+
+type memberStats struct {
+	Members     int
+	HealthScore int // 0 is healthy; higher means we're struggling to keep up
+	Nodes       []string
+}
+
+type leveldbStats struct {
+	Stats            string // leveldb.stats, as LevelDB formats it
+	ApproximateBytes uint64
+}
+
+type nodeStats struct {
+	Node          string
+	Version       string
+	Started       time.Time
+	UptimeSeconds float64
+	Peers         map[string]string // connected peers' ROUTER addresses
+	Memberlist    memberStats
+	LevelDB       leveldbStats
+	Requests      map[string]float64 // since starting, by method
+	Siblings      float64            // reads that found siblings
+	ReadRepairs   float64
+	Partitions    []int          // the ones this node owns
+	Ownership     map[string]int // partitions owned by each node
+}
+
+// GetStats describes this node and what it thinks of the cluster, for
+// people rather than for Prometheus.
+func GetStats(info NodeInfo, pl *peers.PeerList, list *ml.Memberlist, s *store.Store, enc Encoder, res http.ResponseWriter) (int, string) {
+	members := list.Members()
+	names := make([]string, 0, len(members))
+	for _, n := range members {
+		names = append(names, n.Name)
+	}
+	sort.Strings(names)
+
+	requests := make(map[string]float64)
+	for _, method := range []string{"GET", "PUT", "POST", "DELETE"} {
+		requests[method] = metrics.Sum("mec_http_requests_total", "method", method)
+	}
+
+	r := pl.Ring()
+	ownership := make(map[string]int)
+	for _, m := range r.Members() {
+		ownership[m.Name] = len(r.Claim(m.Name))
+	}
+
+	return respond(res, enc, http.StatusOK, "stats", nodeStats{
+		Node:          info.Name,
+		Version:       info.Version,
+		Started:       info.Started,
+		UptimeSeconds: time.Since(info.Started).Seconds(),
+		Peers:         pl.Connected(),
+		Memberlist:    memberStats{list.NumMembers(), list.GetHealthScore(), names},
+		LevelDB:       leveldbStats{s.DBProperty("leveldb.stats"), s.ApproximateSize()},
+		Requests:      requests,
+		Siblings:      metrics.Sum("mec_sibling_reads_total", "", ""),
+		ReadRepairs:   metrics.Sum("mec_read_repairs_total", "", ""),
+		Partitions:    r.Claim(info.Name),
+		Ownership:     ownership,
+	})
+}
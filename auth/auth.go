@@ -0,0 +1,127 @@
+package auth
+
+import (
+	"code.google.com/p/go.crypto/bcrypt"
+	"errors"
+	"fmt"
+	"github.com/codegangsta/martini"
+	apierrors "github.com/cormacrelf/mec-db/api/apierrors"
+	"net/http"
+	"strings"
+)
+
+// Client authentication for the HTTP API, as martini middleware.
+//
+//     m.Use(auth.Handler(auth.Token(users), auth.Basic(users)))
+//     r.Put(`/mec/:key`, auth.Require(auth.Write), api.Put)
+
+var ErrBadCredentials = errors.New("bad credentials")
+
+// An Authenticator identifies the user making a request. It returns a nil
+// User and a nil error when the request carries no credentials it
+// understands, so the next Authenticator can have a go.
+type Authenticator interface {
+	Authenticate(req *http.Request) (*User, error)
+}
+
+type tokenAuth struct{ users *Users }
+
+// Token authenticates `Authorization: Bearer <token>` against each user's
+// static API tokens.
+func Token(users *Users) Authenticator {
+	return tokenAuth{users}
+}
+
+func (t tokenAuth) Authenticate(req *http.Request) (*User, error) {
+	h := req.Header.Get("Authorization")
+	if !strings.HasPrefix(h, "Bearer ") {
+		return nil, nil
+	}
+	u, ok := t.users.ByToken(strings.TrimSpace(h[len("Bearer "):]))
+	if !ok {
+		return nil, ErrBadCredentials
+	}
+	return u, nil
+}
+
+type basicAuth struct{ users *Users }
+
+// Basic authenticates HTTP basic credentials against each user's bcrypt
+// password hash.
+func Basic(users *Users) Authenticator {
+	return basicAuth{users}
+}
+
+func (b basicAuth) Authenticate(req *http.Request) (*User, error) {
+	name, password, ok := req.BasicAuth()
+	if !ok {
+		return nil, nil
+	}
+	u, ok := b.users.Lookup(name)
+	if !ok || u.Password == "" {
+		return nil, ErrBadCredentials
+	}
+	if bcrypt.CompareHashAndPassword([]byte(u.Password), []byte(password)) != nil {
+		return nil, ErrBadCredentials
+	}
+	return u, nil
+}
+
+type certAuth struct{ users *Users }
+
+// Cert authenticates a verified TLS client certificate whose CommonName is
+// a user's name. Only useful when mutual TLS is on.
+func Cert(users *Users) Authenticator {
+	return certAuth{users}
+}
+
+func (c certAuth) Authenticate(req *http.Request) (*User, error) {
+	if req.TLS == nil || len(req.TLS.VerifiedChains) == 0 {
+		return nil, nil
+	}
+	name := req.TLS.VerifiedChains[0][0].Subject.CommonName
+	u, ok := c.users.Lookup(name)
+	if !ok {
+		return nil, nil
+	}
+	return u, nil
+}
+
+// Handler maps the authenticated *User into the request context, or
+// responds 401. With no authenticators every request is Anonymous. Errors
+// go out through the request's apierrors.Writer, so it must come after
+// whatever maps one.
+func Handler(auths ...Authenticator) martini.Handler {
+	return func(c martini.Context, errs apierrors.Writer, res http.ResponseWriter, req *http.Request) {
+		if len(auths) == 0 {
+			c.Map(Anonymous)
+			return
+		}
+		for _, a := range auths {
+			u, err := a.Authenticate(req)
+			if err != nil {
+				break
+			}
+			if u != nil {
+				c.Map(u)
+				return
+			}
+		}
+		res.Header().Set("WWW-Authenticate", `Basic realm="mec"`)
+		errs(res, apierrors.NewError(apierrors.StatusUnauthorized, "unauthorized"))
+	}
+}
+
+// Require responds 403 unless the authenticated user has permission p on
+// the route's :key (or globally, for routes without one).
+func Require(p Permission) martini.Handler {
+	return func(u *User, params martini.Params, errs apierrors.Writer, res http.ResponseWriter) {
+		if key := params["key"]; !u.Can(p, key) {
+			msg := fmt.Sprintf("%s doesn't have %s permission", u.Name, p)
+			if key != "" {
+				msg += " on " + key
+			}
+			errs(res, apierrors.NewError(apierrors.StatusForbidden, msg))
+		}
+	}
+}
@@ -0,0 +1,27 @@
+package auth
+
+import (
+	"github.com/codegangsta/martini"
+	apierrors "github.com/cormacrelf/mec-db/api/apierrors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRequireWritesError(t *testing.T) {
+	require := Require(Write).(func(*User, martini.Params, apierrors.Writer, http.ResponseWriter))
+	reader := &User{Name: "reader", perms: Read}
+
+	var got *apierrors.Error
+	errs := func(res http.ResponseWriter, err *apierrors.Error) { got = err }
+	require(reader, martini.Params{"key": "album"}, errs, httptest.NewRecorder())
+	if got == nil || got.Code != apierrors.StatusForbidden || got.Reason != apierrors.ReasonForbidden || got.Retryable {
+		t.Errorf("reader writing: got %+v", got)
+	}
+
+	got = nil
+	require(Anonymous, martini.Params{"key": "album"}, errs, httptest.NewRecorder())
+	if got != nil {
+		t.Errorf("anonymous writing: got %+v", got)
+	}
+}
@@ -0,0 +1,168 @@
+package auth
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"github.com/BurntSushi/toml"
+	"io/ioutil"
+	"strings"
+	"sync"
+)
+
+// A Permission is one of the things a user may be allowed to do.
+type Permission uint8
+
+const (
+	Read Permission = 1 << iota
+	Write
+	Delete
+	Admin
+
+	All = Read | Write | Delete | Admin
+)
+
+var permissionNames = map[string]Permission{
+	"read":   Read,
+	"write":  Write,
+	"delete": Delete,
+	"admin":  Admin,
+	"all":    All,
+}
+
+func (p Permission) String() string {
+	names := make([]string, 0)
+	for _, name := range []string{"read", "write", "delete", "admin"} {
+		if p&permissionNames[name] != 0 {
+			names = append(names, name)
+		}
+	}
+	return strings.Join(names, ",")
+}
+
+func parsePermissions(names []string) (Permission, error) {
+	var acc Permission
+	for _, name := range names {
+		p, ok := permissionNames[strings.ToLower(name)]
+		if !ok {
+			return 0, fmt.Errorf("unknown permission %q", name)
+		}
+		acc |= p
+	}
+	return acc, nil
+}
+
+// A Grant gives a user extra permissions on keys beginning with Prefix.
+type Grant struct {
+	Prefix      string
+	Permissions []string
+	perms       Permission
+}
+
+// { name, bcrypt password hash, API tokens, permissions on every key,
+// and grants for key prefixes }
+type User struct {
+	Name        string
+	Password    string // bcrypt hash, eg from `htpasswd -nbB`
+	Tokens      []string
+	Permissions []string
+	Grant       []Grant
+	perms       Permission
+}
+
+// Anonymous is used for every request when authentication is disabled.
+var Anonymous = &User{Name: "anonymous", perms: All}
+
+// Can reports whether the user may do p to key. An empty key (eg an admin
+// route) only considers the user's global permissions.
+func (u *User) Can(p Permission, key string) bool {
+	if u.perms&p == p {
+		return true
+	}
+	if key == "" {
+		return false
+	}
+	for _, g := range u.Grant {
+		if strings.HasPrefix(key, g.Prefix) && g.perms&p == p {
+			return true
+		}
+	}
+	return false
+}
+
+// Users is the parsed form of a users file:
+//
+//	[[user]]
+//	    name = "alice"
+//	    password = "$2a$10$..."
+//	    tokens = ["3f1c..."]
+//	    permissions = ["read"]
+//	    [[user.grant]]
+//	        prefix = "alice/"
+//	        permissions = ["write", "delete"]
+type Users struct {
+	User   []*User
+	byName map[string]*User
+	mu     sync.RWMutex
+}
+
+// LoadUsers reads and validates a users file.
+func LoadUsers(path string) (*Users, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't read users file %s: %v", path, err)
+	}
+	var us Users
+	if _, err := toml.Decode(string(data), &us); err != nil {
+		return nil, fmt.Errorf("couldn't decode users file %s: %v", path, err)
+	}
+
+	us.byName = make(map[string]*User, len(us.User))
+	for _, u := range us.User {
+		if u.Name == "" {
+			return nil, fmt.Errorf("users file %s: user without a name", path)
+		}
+		if _, dup := us.byName[u.Name]; dup {
+			return nil, fmt.Errorf("users file %s: duplicate user %s", path, u.Name)
+		}
+		if u.perms, err = parsePermissions(u.Permissions); err != nil {
+			return nil, fmt.Errorf("users file %s: user %s: %v", path, u.Name, err)
+		}
+		for i := range u.Grant {
+			if u.Grant[i].perms, err = parsePermissions(u.Grant[i].Permissions); err != nil {
+				return nil, fmt.Errorf("users file %s: user %s: %v", path, u.Name, err)
+			}
+		}
+		us.byName[u.Name] = u
+	}
+	return &us, nil
+}
+
+// Replace swaps the users for fresh ones, from LoadUsers
+func (us *Users) Replace(fresh *Users) {
+	us.mu.Lock()
+	defer us.mu.Unlock()
+	us.User, us.byName = fresh.User, fresh.byName
+}
+
+// Lookup finds a user by name
+func (us *Users) Lookup(name string) (*User, bool) {
+	us.mu.RLock()
+	defer us.mu.RUnlock()
+	u, ok := us.byName[name]
+	return u, ok
+}
+
+// ByToken finds the user with an API token, comparing in constant time
+func (us *Users) ByToken(token string) (*User, bool) {
+	us.mu.RLock()
+	defer us.mu.RUnlock()
+	given := []byte(token)
+	for _, u := range us.User {
+		for _, t := range u.Tokens {
+			if subtle.ConstantTimeCompare(given, []byte(t)) == 1 {
+				return u, true
+			}
+		}
+	}
+	return nil, false
+}
@@ -0,0 +1,39 @@
+package auth
+
+import "testing"
+
+func TestCan(t *testing.T) {
+	u := &User{
+		Name:  "alice",
+		perms: Read,
+		Grant: []Grant{{Prefix: "alice/", perms: Write | Delete}},
+	}
+
+	switch {
+	case !u.Can(Read, "bob/x"):
+		t.Error("global read not honoured")
+	case u.Can(Write, "bob/x"):
+		t.Error("write allowed outside of grant")
+	case !u.Can(Write, "alice/x"):
+		t.Error("write not allowed inside grant")
+	case u.Can(Write|Admin, "alice/x"):
+		t.Error("partial permission treated as whole")
+	case u.Can(Write, ""):
+		t.Error("grant applied to a keyless route")
+	case !Anonymous.Can(Admin, ""):
+		t.Error("anonymous should be allowed everything")
+	}
+}
+
+func TestParsePermissions(t *testing.T) {
+	p, err := parsePermissions([]string{"read", "Write"})
+	if err != nil || p != Read|Write {
+		t.Error("parsed", p, err)
+	}
+	if _, err := parsePermissions([]string{"fly"}); err == nil {
+		t.Error("accepted unknown permission")
+	}
+	if p, _ := parsePermissions([]string{"all"}); p.String() != "read,write,delete,admin" {
+		t.Error("all is", p)
+	}
+}
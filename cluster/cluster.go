@@ -0,0 +1,287 @@
+package cluster
+
+import (
+	"errors"
+	"fmt"
+	"github.com/cormacrelf/mec-db/peers"
+	"github.com/cormacrelf/mec-db/ring"
+	"github.com/cormacrelf/mec-db/store"
+	ml "github.com/hashicorp/memberlist"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Changing the cluster's topology happens in three steps, Riak style: stage
+// some changes on any node (the claimant), look at the plan of partition
+// transfers they need, then commit it. Nodes joined with Join wait in the
+// Joining state, outside the ring, until a commit lets them in.
+
+var ErrNothingStaged = errors.New("nothing to commit")
+
+// { "join"|"leave"|"replace", node, replacement }
+type Change struct {
+	Action string
+	Node   string
+	With   string `json:",omitempty"`
+}
+
+type Plan struct {
+	Changes   []Change
+	Transfers []ring.Transfer
+	Shares    map[string]float64 // of the key space, once committed
+}
+
+type MemberStatus struct {
+	Name    string
+	HTTP    string
+	Zone    string
+	Version string
+	State   string // valid, joining or leaving
+	Health  peers.Health
+	Share   float64 // of the key space
+}
+
+type Claimant struct {
+	sync.Mutex
+	pl     *peers.PeerList
+	list   *ml.Memberlist
+	s      *store.Store
+	staged []Change
+}
+
+func New(pl *peers.PeerList, list *ml.Memberlist, s *store.Store) *Claimant {
+	return &Claimant{pl: pl, list: list, s: s}
+}
+
+// Join makes this node join the cluster addr is in, waiting outside the
+// ring for a commit.
+func (c *Claimant) Join(addr string) error {
+	if c.list.NumMembers() > 1 {
+		return errors.New("already in a cluster")
+	}
+	meta := c.pl.LocalMeta()
+	meta.Joining = true
+	c.pl.SetLocalMeta(meta)
+	c.list.UpdateNode(time.Second)
+	_, err := c.list.Join([]string{addr})
+	return err
+}
+
+// Stage adds a leave or replace to the plan. Joins are staged by the
+// joining node itself.
+func (c *Claimant) Stage(ch Change) error {
+	c.Lock()
+	defer c.Unlock()
+	members := c.pl.Members()
+
+	if _, ok := members[ch.Node]; !ok {
+		return fmt.Errorf("%s isn't a member", ch.Node)
+	}
+	for _, s := range c.staged {
+		if s.Node == ch.Node || (ch.With != "" && s.With == ch.With) {
+			return fmt.Errorf("%s already has a change staged", ch.Node)
+		}
+	}
+	switch ch.Action {
+	case "leave":
+	case "replace":
+		with, ok := members[ch.With]
+		if !ok || !with.Joining {
+			return fmt.Errorf("%s must join before it can replace %s", ch.With, ch.Node)
+		}
+	default:
+		return fmt.Errorf("can't stage %q", ch.Action)
+	}
+
+	c.staged = append(c.staged, ch)
+	return nil
+}
+
+// Clear throws away the staged changes
+func (c *Claimant) Clear() {
+	c.Lock()
+	defer c.Unlock()
+	c.staged = nil
+}
+
+// pending gathers the staged changes and every joining node into one list,
+// with the names of the nodes joining and leaving. It must be called with
+// c locked.
+func (c *Claimant) pending() ([]Change, []string, []string) {
+	changes := make([]Change, len(c.staged))
+	copy(changes, c.staged)
+	joining, leaving := make([]string, 0), make([]string, 0)
+	replacing := make(map[string]bool)
+	for _, ch := range c.staged {
+		leaving = append(leaving, ch.Node)
+		if ch.Action == "replace" {
+			joining = append(joining, ch.With)
+			replacing[ch.With] = true
+		}
+	}
+
+	names := make([]string, 0)
+	for name, m := range c.pl.Members() {
+		if m.Joining && !replacing[name] {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		changes = append(changes, Change{Action: "join", Node: name})
+		joining = append(joining, name)
+	}
+	return changes, joining, leaving
+}
+
+func (c *Claimant) plan() (Plan, []string, []string) {
+	changes, joining, leaving := c.pending()
+	before, after := c.pl.Ring(), c.pl.RingWith(joining, leaving)
+	shares := make(map[string]float64)
+	for _, m := range after.Members() {
+		shares[m.Name] = float64(len(after.Claim(m.Name))) / ring.Partitions
+	}
+	return Plan{changes, ring.Transfers(before, after, c.s.Quorum().N), shares}, joining, leaving
+}
+
+// Plan shows what committing would do
+func (c *Claimant) Plan() Plan {
+	c.Lock()
+	defer c.Unlock()
+	p, _, _ := c.plan()
+	return p
+}
+
+// Commit orders the nodes keeping their partitions to send copies to the
+// nodes gaining them, lets the joining nodes into the ring and tells the
+// leaving ones to leave (they hand off their own data as they go). If any
+// transfer can't be ordered nothing else happens and the plan is kept. A
+// change whose nodes didn't answer stays staged, to commit again once
+// they're back.
+func (c *Claimant) Commit() (Plan, error) {
+	c.Lock()
+	defer c.Unlock()
+	p, joining, leaving := c.plan()
+	if len(p.Changes) == 0 {
+		return p, ErrNothingStaged
+	}
+
+	orders := make(map[string][]ring.Transfer)
+	for _, t := range p.Transfers {
+		if !ring.Contains(leaving, t.From) {
+			orders[t.From] = append(orders[t.From], t)
+		}
+	}
+	for from, ts := range orders {
+		msg, err := store.EncodeTransferMsg(ts)
+		if err != nil {
+			return p, err
+		}
+		if !good(c.pl.MessageExpectResponse(from, msg...)) {
+			return p, fmt.Errorf("%s didn't accept its transfers", from)
+		}
+	}
+
+	failed := make([]string, 0)
+	activated := make([]string, 0, len(joining))
+	for _, name := range joining {
+		if good(c.pl.MessageExpectResponse(name, "CLUSTER", "activate")) {
+			activated = append(activated, name)
+		} else {
+			failed = append(failed, name)
+		}
+	}
+
+	// a node being replaced only goes once its replacement is in
+	kept, going := make([]Change, 0), make([]Change, 0, len(c.staged))
+	goers := make([]string, 0, len(c.staged))
+	for _, ch := range c.staged {
+		if ch.Action == "replace" && !ring.Contains(activated, ch.With) {
+			kept = append(kept, ch)
+			continue
+		}
+		going = append(going, ch)
+		goers = append(goers, ch.Node)
+	}
+
+	// the leavers may not have heard about the others yet, so the order
+	// says who's coming and going
+	order := LeaveOrder(activated, goers)
+	for _, ch := range going {
+		if !good(c.pl.MessageExpectResponse(ch.Node, order...)) {
+			failed = append(failed, ch.Node)
+			kept = append(kept, ch)
+		}
+	}
+	c.staged = kept
+	if len(failed) > 0 {
+		return p, fmt.Errorf("no answer from %v; their changes are still staged, commit again once they're back", failed)
+	}
+	return p, nil
+}
+
+// LeaveOrder is the message telling a node to leave, naming the nodes
+// joining and leaving the ring with it
+func LeaveOrder(joining, leaving []string) []string {
+	msg := []string{"CLUSTER", "leave"}
+	for _, name := range joining {
+		msg = append(msg, "join="+name)
+	}
+	for _, name := range leaving {
+		msg = append(msg, "leave="+name)
+	}
+	return msg
+}
+
+// ParseLeaveOrder takes the frames after "leave" in a leave order and
+// returns the nodes joining and leaving
+func ParseLeaveOrder(frames []string) ([]string, []string) {
+	joining, leaving := make([]string, 0), make([]string, 0)
+	for _, f := range frames {
+		switch {
+		case strings.HasPrefix(f, "join="):
+			joining = append(joining, strings.TrimPrefix(f, "join="))
+		case strings.HasPrefix(f, "leave="):
+			leaving = append(leaving, strings.TrimPrefix(f, "leave="))
+		}
+	}
+	return joining, leaving
+}
+
+// Status describes every member, its health and its share of the key space
+func (c *Claimant) Status() []MemberStatus {
+	r := c.pl.Ring()
+	acc := make([]MemberStatus, 0)
+	for name, m := range c.pl.Members() {
+		state := "valid"
+		switch {
+		case m.Joining:
+			state = "joining"
+		case m.Leaving:
+			state = "leaving"
+		}
+		acc = append(acc, MemberStatus{
+			Name:    name,
+			HTTP:    c.pl.HTTPAddr(name),
+			Zone:    m.Zone,
+			Version: m.Version,
+			State:   state,
+			Health:  c.pl.State(name),
+			Share:   float64(len(r.Claim(name))) / ring.Partitions,
+		})
+	}
+	sort.Sort(byName(acc))
+	return acc
+}
+
+func good(reply []string) bool {
+	return len(reply) > 0 && reply[0] == "GOOD"
+}
+
+type byName []MemberStatus
+
+func (b byName) Len() int           { return len(b) }
+func (b byName) Swap(i, j int)      { b[i], b[j] = b[j], b[i] }
+func (b byName) Less(i, j int) bool { return b[i].Name < b[j].Name }
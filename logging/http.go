@@ -0,0 +1,53 @@
+package logging
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"github.com/codegangsta/martini"
+	"net/http"
+	"time"
+)
+
+// RequestIDHeader carries a request's ID in and out, so a client or proxy
+// can pick it and find it in every node's logs.
+const RequestIDHeader = "X-Request-Id"
+
+// Handler is martini middleware that logs every request when it's done. It
+// maps a *Logger carrying the request's ID for the handlers to pass on, eg
+// with store.WithLog; whoever logs to it adds their own component.
+func Handler() martini.Handler {
+	log := With("component", "http")
+	return func(c martini.Context, res http.ResponseWriter, req *http.Request) {
+		start := time.Now()
+		id := req.Header.Get(RequestIDHeader)
+		if id == "" || len(id) > 64 {
+			id = newRequestID()
+		}
+		res.Header().Set(RequestIDHeader, id)
+
+		c.Map(With("request", id))
+		c.Next()
+
+		status := http.StatusOK
+		if rw, ok := res.(martini.ResponseWriter); ok && rw.Status() != 0 {
+			status = rw.Status()
+		}
+		level := Info
+		if status >= 500 {
+			level = Warn
+		}
+		fields := []interface{}{"method", req.Method, "path", req.URL.Path,
+			"status", status, "duration", time.Since(start), "remote", req.RemoteAddr}
+		// set by the tracing middleware, when it's on
+		if tp := res.Header().Get("traceparent"); tp != "" {
+			fields = append(fields, "traceparent", tp)
+		}
+		log.Log(level, "request", append(fields, "request", id)...)
+	}
+}
+
+func newRequestID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
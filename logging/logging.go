@@ -0,0 +1,174 @@
+package logging
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Levelled logging with fields, as text or JSON lines. Each package keeps a
+// Logger with its own fields and adds more as it goes:
+//
+//     var log = logging.With("component", "store")
+//     log.With("key", key).Warn("handoff failed", "err", err)
+//
+// Fields are given as alternating names and values.
+
+type Level int
+
+const (
+	Debug Level = iota
+	Info
+	Warn
+	Error
+)
+
+var levelNames = []string{"debug", "info", "warn", "error"}
+
+func (l Level) String() string {
+	if l < Debug || l > Error {
+		return fmt.Sprintf("level(%d)", int(l))
+	}
+	return levelNames[l]
+}
+
+// ParseLevel understands the names Level.String gives, in any case
+func ParseLevel(s string) (Level, error) {
+	for i, name := range levelNames {
+		if strings.EqualFold(s, name) {
+			return Level(i), nil
+		}
+	}
+	return Info, fmt.Errorf("unknown log level %q", s)
+}
+
+// where every Logger writes, and what it lets through
+var out = struct {
+	sync.Mutex
+	w      io.Writer
+	level  Level
+	json   bool
+	fields []interface{} // on every line, eg the node name
+}{w: os.Stderr, level: Info}
+
+// Configure sets where logs go, the least important level written, and
+// whether lines are JSON objects rather than text.
+func Configure(w io.Writer, level Level, asJSON bool) {
+	out.Lock()
+	defer out.Unlock()
+	out.w, out.level, out.json = w, level, asJSON
+}
+
+// SetLevel changes the level on the fly
+func SetLevel(level Level) {
+	out.Lock()
+	defer out.Unlock()
+	out.level = level
+}
+
+// Always adds fields to every line from every Logger
+func Always(kv ...interface{}) {
+	out.Lock()
+	defer out.Unlock()
+	out.fields = append(out.fields, kv...)
+}
+
+// Enabled reports whether lines at level are being written, for skipping
+// work that would only be thrown away.
+func Enabled(level Level) bool {
+	out.Lock()
+	defer out.Unlock()
+	return level >= out.level
+}
+
+// A Logger writes lines carrying its fields. The zero Logger has none.
+type Logger struct {
+	fields []interface{}
+}
+
+// With returns a Logger with more fields
+func With(kv ...interface{}) *Logger {
+	return (&Logger{}).With(kv...)
+}
+
+func (l *Logger) With(kv ...interface{}) *Logger {
+	fields := make([]interface{}, 0, len(l.fields)+len(kv))
+	fields = append(fields, l.fields...)
+	return &Logger{append(fields, kv...)}
+}
+
+func (l *Logger) Debug(msg string, kv ...interface{}) { l.Log(Debug, msg, kv...) }
+func (l *Logger) Info(msg string, kv ...interface{})  { l.Log(Info, msg, kv...) }
+func (l *Logger) Warn(msg string, kv ...interface{})  { l.Log(Warn, msg, kv...) }
+func (l *Logger) Error(msg string, kv ...interface{}) { l.Log(Error, msg, kv...) }
+
+func (l *Logger) Log(level Level, msg string, kv ...interface{}) {
+	out.Lock()
+	defer out.Unlock()
+	if level < out.level {
+		return
+	}
+
+	fields := make([]interface{}, 0, len(out.fields)+len(l.fields)+len(kv))
+	fields = append(fields, out.fields...)
+	fields = append(fields, l.fields...)
+	fields = append(fields, kv...)
+
+	var line []byte
+	if out.json {
+		line = formatJSON(time.Now(), level, msg, fields)
+	} else {
+		line = formatText(time.Now(), level, msg, fields)
+	}
+	out.w.Write(line)
+}
+
+func formatText(t time.Time, level Level, msg string, fields []interface{}) []byte {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "%s %-5s %s", t.Format("2006-01-02T15:04:05.000Z07:00"), strings.ToUpper(level.String()), msg)
+	for i := 0; i < len(fields); i += 2 {
+		k, v := pair(fields, i)
+		s := fmt.Sprint(v)
+		if s == "" || strings.ContainsAny(s, " \t\n\"=") {
+			s = fmt.Sprintf("%q", s)
+		}
+		fmt.Fprintf(&b, " %s=%s", k, s)
+	}
+	b.WriteByte('\n')
+	return b.Bytes()
+}
+
+func formatJSON(t time.Time, level Level, msg string, fields []interface{}) []byte {
+	obj := make(map[string]interface{}, len(fields)/2+3)
+	for i := 0; i < len(fields); i += 2 {
+		k, v := pair(fields, i)
+		if err, ok := v.(error); ok {
+			v = err.Error()
+		}
+		obj[k] = v
+	}
+	obj["time"] = t.Format(time.RFC3339Nano)
+	obj["level"] = level.String()
+	obj["msg"] = msg
+
+	b, err := json.Marshal(obj)
+	if err != nil {
+		b, _ = json.Marshal(map[string]string{"time": t.Format(time.RFC3339Nano), "level": level.String(), "msg": msg, "logerror": err.Error()})
+	}
+	return append(b, '\n')
+}
+
+// pair takes fields[i] as a name and fields[i+1] as its value, coping with
+// a name missing its value
+func pair(fields []interface{}, i int) (string, interface{}) {
+	k := fmt.Sprint(fields[i])
+	if i+1 >= len(fields) {
+		return k, "(missing)"
+	}
+	return k, fields[i+1]
+}
@@ -0,0 +1,67 @@
+package logging
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestLevelsAndFields(t *testing.T) {
+	var b bytes.Buffer
+	Configure(&b, Info, false)
+	log := With("component", "store")
+
+	log.Debug("hidden")
+	log.With("key", "a b").Warn("handoff failed", "err", errors.New("timeout"))
+
+	out := b.String()
+	if strings.Contains(out, "hidden") {
+		t.Error("wrote a debug line at info level")
+	}
+	for _, want := range []string{"WARN", "handoff failed", "component=store", `key="a b"`, "err=timeout"} {
+		if !strings.Contains(out, want) {
+			t.Errorf("missing %q in %q", want, out)
+		}
+	}
+}
+
+func TestJSON(t *testing.T) {
+	var b bytes.Buffer
+	Configure(&b, Debug, true)
+	With("peer", "n2").Error("dealer send error", "err", errors.New("gone"))
+
+	var line map[string]interface{}
+	if err := json.Unmarshal(b.Bytes(), &line); err != nil {
+		t.Fatal(err, b.String())
+	}
+	if line["level"] != "error" || line["msg"] != "dealer send error" || line["peer"] != "n2" || line["err"] != "gone" {
+		t.Error("logged", line)
+	}
+}
+
+func TestWriter(t *testing.T) {
+	var b bytes.Buffer
+	Configure(&b, Info, false)
+	w := With("component", "memberlist").Writer()
+	w.Write([]byte("2014/01/18 10:49:23 [DEBUG] memberlist: quiet\n2014/01/18 10:49:23 [WARN] memberlist: "))
+	w.Write([]byte("refuting a suspect message\n"))
+
+	out := b.String()
+	if strings.Contains(out, "quiet") {
+		t.Error("debug line got through")
+	}
+	if !strings.Contains(out, "WARN  memberlist: refuting a suspect message") || strings.Contains(out, "2014/01/18") {
+		t.Errorf("warning not logged properly: %q", out)
+	}
+}
+
+func TestParseLevel(t *testing.T) {
+	if l, err := ParseLevel("WARN"); err != nil || l != Warn {
+		t.Error("parsed", l, err)
+	}
+	if _, err := ParseLevel("loud"); err == nil {
+		t.Error("accepted unknown level")
+	}
+}
@@ -0,0 +1,56 @@
+package logging
+
+import (
+	"bytes"
+	"strings"
+	"sync"
+)
+
+// Writer adapts l for libraries that log through the standard log package,
+// like memberlist. A "[DEBUG]", "[INFO]", "[WARN]" or "[ERR]" tag picks the
+// level of each line; the library's own timestamp is dropped.
+func (l *Logger) Writer() *LineWriter {
+	return &LineWriter{l: l}
+}
+
+type LineWriter struct {
+	l   *Logger
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+var tags = map[string]Level{
+	"[DEBUG]": Debug,
+	"[INFO]":  Info,
+	"[WARN]":  Warn,
+	"[ERR]":   Error,
+	"[ERROR]": Error,
+}
+
+func (w *LineWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.buf.Write(p)
+	for {
+		i := bytes.IndexByte(w.buf.Bytes(), '\n')
+		if i < 0 {
+			return len(p), nil
+		}
+		line := string(w.buf.Next(i + 1))
+		w.logLine(strings.TrimRight(line, "\r\n"))
+	}
+}
+
+func (w *LineWriter) logLine(line string) {
+	level := Info
+	for tag, l := range tags {
+		if i := strings.Index(line, tag); i >= 0 {
+			level = l
+			line = line[i+len(tag):]
+			break
+		}
+	}
+	if line = strings.TrimSpace(line); line != "" {
+		w.l.Log(level, line)
+	}
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"text/tabwriter"
+)
+
+// mec-admin drives a node's /admin/cluster endpoints.
+
+const usage = `usage: mec-admin [flags] <command>
+
+commands:
+  status                   every member, its health and share of the key space
+  join <host:port>         make the node join the cluster with a member gossiping at host:port
+  leave <node>             stage node leaving the cluster
+  replace <node> <with>    stage node handing everything to <with>, which has joined
+  plan                     show the staged changes and the transfers they need
+  clear                    throw away the staged changes
+  commit                   carry out the plan
+
+flags:
+`
+
+var (
+	node     = flag.String("node", "127.0.0.1:3000", "host:port of a node's HTTP API")
+	secure   = flag.Bool("https", false, "talk to the node over HTTPS")
+	insecure = flag.Bool("insecure", false, "don't verify the node's certificate")
+	token    = flag.String("token", os.Getenv("MEC_TOKEN"), "API token of an admin user")
+	cert     = flag.String("cert", "", "client certificate, for a node that requires one")
+	key      = flag.String("key", "", "the client certificate's key")
+)
+
+type change struct {
+	Action, Node, With string
+}
+
+type transfer struct {
+	Partition int
+	From, To  string
+}
+
+type plan struct {
+	Changes   []change
+	Transfers []transfer
+	Shares    map[string]float64
+}
+
+type member struct {
+	Name, HTTP, Zone, Version, State, Health string
+	Share                                    float64
+}
+
+func main() {
+	flag.Usage = func() {
+		fmt.Fprint(os.Stderr, usage)
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	args := flag.Args()
+	if len(args) == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	var err error
+	switch {
+	case args[0] == "status" && len(args) == 1:
+		var ms []member
+		if err = call("GET", "/admin/cluster", nil, &ms); err == nil {
+			printStatus(ms)
+		}
+	case args[0] == "join" && len(args) == 2:
+		var ms []member
+		if err = call("POST", "/admin/cluster/join", url.Values{"addr": {args[1]}}, &ms); err == nil {
+			printStatus(ms)
+		}
+	case args[0] == "leave" && len(args) == 2:
+		err = callPlan("POST", "/admin/cluster/leave", url.Values{"node": {args[1]}})
+	case args[0] == "replace" && len(args) == 3:
+		err = callPlan("POST", "/admin/cluster/replace", url.Values{"node": {args[1]}, "with": {args[2]}})
+	case args[0] == "plan" && len(args) == 1:
+		err = callPlan("GET", "/admin/cluster/plan", nil)
+	case args[0] == "clear" && len(args) == 1:
+		err = callPlan("DELETE", "/admin/cluster/plan", nil)
+	case args[0] == "commit" && len(args) == 1:
+		err = callPlan("POST", "/admin/cluster/commit", nil)
+	default:
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+// call makes a request to the node and decodes its JSON answer into v
+func call(method, path string, form url.Values, v interface{}) error {
+	scheme := "http"
+	client := &http.Client{}
+	if *secure {
+		scheme = "https"
+		tc := &tls.Config{InsecureSkipVerify: *insecure}
+		if *cert != "" || *key != "" {
+			c, err := tls.LoadX509KeyPair(*cert, *key)
+			if err != nil {
+				return fmt.Errorf("couldn't load the client certificate: %v", err)
+			}
+			tc.Certificates = []tls.Certificate{c}
+		}
+		client.Transport = &http.Transport{TLSClientConfig: tc}
+	} else if *cert != "" {
+		return errors.New("--cert needs --https")
+	}
+
+	u := fmt.Sprintf("%s://%s%s", scheme, *node, path)
+	if form != nil {
+		u += "?" + form.Encode()
+	}
+	req, err := http.NewRequest(method, u, nil)
+	if err != nil {
+		return err
+	}
+	if *token != "" {
+		req.Header.Set("Authorization", "Bearer "+*token)
+	}
+
+	res, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return err
+	}
+	if res.StatusCode != http.StatusOK {
+		var e struct{ Error string }
+		if json.Unmarshal(body, &e) == nil && e.Error != "" {
+			return fmt.Errorf("%s: %s", res.Status, e.Error)
+		}
+		return fmt.Errorf("%s: %s", res.Status, body)
+	}
+	return json.Unmarshal(body, v)
+}
+
+func callPlan(method, path string, form url.Values) error {
+	var p plan
+	err := call(method, path, form, &p)
+	if err == nil {
+		printPlan(p)
+	}
+	return err
+}
+
+func printStatus(ms []member) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "NODE\tSTATE\tHEALTH\tSHARE\tZONE\tHTTP\tVERSION")
+	for _, m := range ms {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%5.1f%%\t%s\t%s\t%s\n",
+			m.Name, m.State, m.Health, m.Share*100, m.Zone, m.HTTP, m.Version)
+	}
+	w.Flush()
+}
+
+func printPlan(p plan) {
+	if len(p.Changes) == 0 {
+		fmt.Println("nothing staged")
+		return
+	}
+	fmt.Println("changes:")
+	for _, c := range p.Changes {
+		if c.With != "" {
+			fmt.Printf("  %s %s with %s\n", c.Action, c.Node, c.With)
+		} else {
+			fmt.Printf("  %s %s\n", c.Action, c.Node)
+		}
+	}
+
+	fmt.Printf("\n%d partition transfers:\n", len(p.Transfers))
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	for _, t := range p.Transfers {
+		fmt.Fprintf(w, "  %d\t%s\t-> %s\n", t.Partition, t.From, t.To)
+	}
+	w.Flush()
+
+	fmt.Println("\nshares afterwards:")
+	names := make([]string, 0, len(p.Shares))
+	for name := range p.Shares {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Printf("  %s %5.1f%%\n", name, p.Shares[name]*100)
+	}
+}
@@ -2,13 +2,23 @@ package main
 
 import (
 	"code.google.com/p/go-uuid/uuid"
+	"errors"
 	"flag"
 	"fmt"
 	"github.com/BurntSushi/toml"
+	"github.com/cormacrelf/mec-db/auth"
+	"github.com/cormacrelf/mec-db/logging"
+	"github.com/cormacrelf/mec-db/store"
 	"io/ioutil"
+	"net"
 	"os"
 	"os/user"
 	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 )
 
 type Node struct {
@@ -17,16 +27,373 @@ type Node struct {
 }
 
 type Config struct {
-	Name     string
-	Port     int
-	HTTPPort int
-	Node    []Node
-	Root     string // Database directory
+	Name        string
+	Port        int // gossip
+	ClusterPort int // ZeroMQ ROUTER
+	HTTPPort    int
+	Zone        string // data centre, rack, etc
+	Weight      int    // relative capacity
+	Node        []Node
+	Root        string // Database directory
+	CacheSize   int    // LevelDB block cache, bytes
+
+	// Where each listener binds, and the address other nodes should use to
+	// reach it if that's different (NAT, containers). Binds are IP
+	// addresses, empty for all interfaces; Bind is the default for all
+	// three. HTTPBind may also be unix:/path/to/socket.
+	Bind                          string
+	GossipBind, GossipAdvertise   string
+	ClusterBind, ClusterAdvertise string
+	HTTPBind, HTTPAdvertise       string
+
+	// Diagnostics (pprof, goroutines, the peers daemon, LevelDB) with no
+	// authentication. Off unless AdminPort is set; loopback by default.
+	AdminPort int
+	AdminBind string
+
+	// Replicas per key, and how many must answer a read or acknowledge a
+	// write. R, W and the timeouts are reloaded on SIGHUP.
+	N, R, W      int
+	Timeout      duration // waiting for other nodes
+	DrainTimeout duration // waiting for HTTP requests when shutting down
+
+	// Overload protection: goroutines handling messages from other nodes,
+	// sharded by key, how many of each type may queue before the sender is
+	// told the node is busy, and how many key requests the HTTP API runs at
+	// once.
+	Workers     int
+	QueueDepth  int
+	MaxRequests int
+
+	// Whose entry in a key's vector clock a write increments: "node", the
+	// node coordinating the write, or "client", the X-Mec-Client-ID header.
+	Actor string
+
+	// "strict" turns away X-Mec-Vclock headers that don't decode or aren't
+	// valid clocks, "lenient" quietly starts a fresh clock instead. Clocks
+	// over the size limits are turned away either way.
+	VClockMode       string
+	VClockMaxBytes   int
+	VClockMaxEntries int
+
+	// HTTP API security, all optional
+	TLSCert     string // PEM certificate; enables HTTPS with TLSKey
+	TLSKey      string
+	TLSClientCA string // PEM CA bundle; requires client certificates
+	Users       string // users file; enables authentication. Reloaded on SIGHUP
+
+	LogLevel  string // debug, info, warn or error. Reloaded on SIGHUP
+	LogFormat string // text or json
+
+	// Where to send request traces, as OTLP JSON: an OTLP/HTTP URL such as
+	// http://localhost:4318/v1/traces, or file:/path. Off if empty.
+	Trace string
 }
 
-func GetConfig() Config {
-	var conf Config
+// duration lets TOML and environment variables say "2s" or "500ms"
+type duration struct {
+	time.Duration
+}
+
+func (d *duration) UnmarshalText(text []byte) error {
+	var err error
+	d.Duration, err = time.ParseDuration(string(text))
+	return err
+}
+
+func defaultConfig() Config {
+	return Config{
+		Port:             7000,
+		HTTPPort:         3000,
+		Weight:           1,
+		CacheSize:        3 << 30,
+		N:                store.DefaultQuorum.N,
+		R:                store.DefaultQuorum.R,
+		W:                store.DefaultQuorum.W,
+		Timeout:          duration{2 * time.Second},
+		DrainTimeout:     duration{10 * time.Second},
+		Workers:          store.DefaultLimits.Workers,
+		QueueDepth:       store.DefaultLimits.Queue,
+		MaxRequests:      512,
+		Actor:            "node",
+		VClockMode:       "strict",
+		VClockMaxBytes:   store.DefaultClockPolicy.MaxBytes,
+		VClockMaxEntries: store.DefaultClockPolicy.MaxEntries,
+		AdminBind:        "127.0.0.1",
+		LogLevel:         "info",
+		LogFormat:        "text",
+	}
+}
+
+// LoadConfig reads the config file at path over the defaults, applies any
+// MEC_* environment variables over that, fills in the defaults that depend
+// on other settings, and checks the result.
+func LoadConfig(path string) (Config, error) {
+	conf := defaultConfig()
+
+	tomlData, err := ioutil.ReadFile(path)
+	if err != nil {
+		return conf, fmt.Errorf("couldn't read config file: %v", err)
+	}
+	if _, err := toml.Decode(string(tomlData), &conf); err != nil {
+		return conf, fmt.Errorf("couldn't decode config file %s: %v", path, err)
+	}
+	if err := applyEnv(&conf, os.LookupEnv); err != nil {
+		return conf, err
+	}
+
+	if conf.Name == "" {
+		conf.Name = generatedName()
+	}
+	if conf.ClusterPort == 0 {
+		conf.ClusterPort = conf.Port + 1
+	}
+	for _, b := range []*string{&conf.GossipBind, &conf.ClusterBind, &conf.HTTPBind} {
+		if *b == "" {
+			*b = conf.Bind
+		}
+	}
+	if conf.Root == "" {
+		usr, err := user.Current()
+		if err != nil {
+			return conf, fmt.Errorf("no root configured and no home directory: %v", err)
+		}
+		conf.Root = fmt.Sprintf("%s/mec/%s", usr.HomeDir, conf.Name)
+	}
+
+	return conf, conf.Validate()
+}
+
+// The name of a node without one configured. It's made up once, so a
+// reload doesn't see a new name (and a new root) every time.
+var generated struct {
+	sync.Once
+	name string
+}
+
+func generatedName() string {
+	generated.Do(func() {
+		generated.name = uuid.New()
+		log.Info("no name configured", "name", generated.name)
+	})
+	return generated.name
+}
+
+// applyEnv overrides settings from MEC_<SETTING> variables, eg MEC_HTTPPORT
+// or MEC_TIMEOUT=500ms. MEC_NODE is a comma-separated list of host:port.
+func applyEnv(conf *Config, lookup func(string) (string, bool)) error {
+	v := reflect.ValueOf(conf).Elem()
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		name := "MEC_" + strings.ToUpper(t.Field(i).Name)
+		text, ok := lookup(name)
+		if !ok {
+			continue
+		}
+
+		field := v.Field(i)
+		switch field.Interface().(type) {
+		case string:
+			field.SetString(text)
+		case int:
+			n, err := strconv.Atoi(text)
+			if err != nil {
+				return fmt.Errorf("%s: %q isn't a number", name, text)
+			}
+			field.SetInt(int64(n))
+		case duration:
+			var d duration
+			if err := d.UnmarshalText([]byte(text)); err != nil {
+				return fmt.Errorf("%s: %v", name, err)
+			}
+			field.Set(reflect.ValueOf(d))
+		case []Node:
+			nodes, err := parseNodes(text)
+			if err != nil {
+				return fmt.Errorf("%s: %v", name, err)
+			}
+			field.Set(reflect.ValueOf(nodes))
+		}
+	}
+	return nil
+}
+
+func parseNodes(text string) ([]Node, error) {
+	nodes := make([]Node, 0)
+	for _, hp := range strings.Split(text, ",") {
+		if hp = strings.TrimSpace(hp); hp == "" {
+			continue
+		}
+		host, port, err := net.SplitHostPort(hp)
+		if err != nil {
+			return nil, err
+		}
+		n, err := strconv.Atoi(port)
+		if err != nil {
+			return nil, fmt.Errorf("%q isn't a port", port)
+		}
+		nodes = append(nodes, Node{host, n})
+	}
+	return nodes, nil
+}
 
+func validPort(p int) bool {
+	return p > 0 && p < 65536
+}
+
+// Validate explains the first thing wrong with the config, if anything
+func (conf Config) Validate() error {
+	ports := map[string]int{"port": conf.Port, "clusterport": conf.ClusterPort, "httpport": conf.HTTPPort}
+	seen := make(map[int]string)
+	for _, name := range []string{"port", "clusterport", "httpport"} {
+		p := ports[name]
+		if !validPort(p) {
+			return fmt.Errorf("%s %d isn't a valid port", name, p)
+		}
+		if other, dup := seen[p]; dup {
+			return fmt.Errorf("%s and %s are both %d", other, name, p)
+		}
+		seen[p] = name
+	}
+	if conf.AdminPort != 0 {
+		if !validPort(conf.AdminPort) {
+			return fmt.Errorf("adminport %d isn't a valid port", conf.AdminPort)
+		}
+		if other, dup := seen[conf.AdminPort]; dup {
+			return fmt.Errorf("%s and adminport are both %d", other, conf.AdminPort)
+		}
+	}
+	if err := conf.validAddresses(); err != nil {
+		return err
+	}
+
+	for i, n := range conf.Node {
+		if n.Host == "" {
+			return fmt.Errorf("node %d has no host", i+1)
+		}
+		if !validPort(n.Port) {
+			return fmt.Errorf("node %d (%s) has invalid port %d", i+1, n.Host, n.Port)
+		}
+	}
+
+	if conf.Weight < 1 {
+		return errors.New("weight must be at least 1")
+	}
+	if conf.CacheSize < 0 {
+		return errors.New("cachesize can't be negative")
+	}
+	if err := validQuorum(conf.N, conf.R, conf.W); err != nil {
+		return err
+	}
+	if conf.Timeout.Duration <= 0 || conf.DrainTimeout.Duration <= 0 {
+		return errors.New("timeouts must be positive")
+	}
+	if conf.Workers < 1 || conf.QueueDepth < 1 || conf.MaxRequests < 1 {
+		return errors.New("workers, queuedepth and maxrequests must be at least 1")
+	}
+
+	if _, err := actors(conf.Actor); err != nil {
+		return err
+	}
+	if conf.VClockMode != "strict" && conf.VClockMode != "lenient" {
+		return fmt.Errorf("vclockmode %q should be strict or lenient", conf.VClockMode)
+	}
+	if conf.VClockMaxBytes < 1 || conf.VClockMaxEntries < 1 {
+		return errors.New("vclockmaxbytes and vclockmaxentries must be at least 1")
+	}
+
+	if _, err := logging.ParseLevel(conf.LogLevel); err != nil {
+		return err
+	}
+	if conf.LogFormat != "text" && conf.LogFormat != "json" {
+		return fmt.Errorf("logformat %q should be text or json", conf.LogFormat)
+	}
+
+	if t := conf.Trace; t != "" {
+		if strings.HasPrefix(t, "file:") {
+			if !filepath.IsAbs(strings.TrimPrefix(t, "file:")) {
+				return fmt.Errorf("trace %q must be an absolute path", t)
+			}
+		} else if !strings.HasPrefix(t, "http://") && !strings.HasPrefix(t, "https://") {
+			return fmt.Errorf("trace %q should be file:/path or an http(s) URL", t)
+		}
+	}
+
+	if !filepath.IsAbs(conf.Root) {
+		return fmt.Errorf("root %q must be an absolute path", conf.Root)
+	}
+	if fi, err := os.Stat(conf.Root); err == nil && !fi.IsDir() {
+		return fmt.Errorf("root %s isn't a directory", conf.Root)
+	}
+
+	if (conf.TLSCert == "") != (conf.TLSKey == "") {
+		return errors.New("tlscert and tlskey must be given together")
+	}
+	if conf.TLSClientCA != "" && conf.TLSCert == "" {
+		return errors.New("tlsclientca needs tlscert and tlskey")
+	}
+	for _, f := range []string{conf.TLSCert, conf.TLSKey, conf.TLSClientCA, conf.Users} {
+		if f == "" {
+			continue
+		}
+		if _, err := os.Stat(f); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// unixPrefix marks an HTTPBind that is a unix socket path
+const unixPrefix = "unix:"
+
+func (conf Config) validAddresses() error {
+	binds := map[string]string{"bind": conf.Bind, "gossipbind": conf.GossipBind, "clusterbind": conf.ClusterBind, "adminbind": conf.AdminBind}
+	if !strings.HasPrefix(conf.HTTPBind, unixPrefix) {
+		binds["httpbind"] = conf.HTTPBind
+	} else if !filepath.IsAbs(strings.TrimPrefix(conf.HTTPBind, unixPrefix)) {
+		return fmt.Errorf("httpbind %q must be an absolute socket path", conf.HTTPBind)
+	}
+	for name, b := range binds {
+		if b != "" && net.ParseIP(b) == nil {
+			return fmt.Errorf("%s %q isn't an IP address", name, b)
+		}
+	}
+
+	// memberlist wants an IP; the others can be looked up by their peers
+	if a := conf.GossipAdvertise; a != "" && (net.ParseIP(a) == nil || net.ParseIP(a).IsUnspecified()) {
+		return fmt.Errorf("gossipadvertise %q isn't a usable IP address", a)
+	}
+	advertised := map[string]string{"clusteradvertise": conf.ClusterAdvertise, "httpadvertise": conf.HTTPAdvertise}
+	for name, a := range advertised {
+		if a == "" {
+			continue
+		}
+		if strings.ContainsAny(a, " /[]") || (strings.Contains(a, ":") && net.ParseIP(a) == nil) {
+			return fmt.Errorf("%s %q should be a host name or IP address, without a port", name, a)
+		}
+		if ip := net.ParseIP(a); ip != nil && ip.IsUnspecified() {
+			return fmt.Errorf("%s %q can't be reached", name, a)
+		}
+	}
+	return nil
+}
+
+func validQuorum(n, r, w int) error {
+	switch {
+	case n < 1:
+		return errors.New("n must be at least 1")
+	case r < 1 || r > n:
+		return fmt.Errorf("r must be between 1 and n (%d)", n)
+	case w < 1 || w > n:
+		return fmt.Errorf("w must be between 1 and n (%d)", n)
+	}
+	return nil
+}
+
+var configPath string
+
+// GetConfig loads the config file named by --config, exiting if it's no good.
+func GetConfig() Config {
 	usr, _ := user.Current()
 	dir := usr.HomeDir
 
@@ -34,33 +401,99 @@ func GetConfig() Config {
 	var loc = flag.String("config", fallback, "specify a config file")
 	flag.Parse()
 
-	location, _ := filepath.Abs(*loc)
-	tomlData, err := ioutil.ReadFile(location)
+	configPath, _ = filepath.Abs(*loc)
+	conf, err := LoadConfig(configPath)
 	if err != nil {
-		fmt.Printf("couln't find config file %s", *loc)
+		log.Error("bad config", "file", configPath, "err", err)
 		os.Exit(1)
 	}
+	live.conf = conf
+
+	return conf
+}
+
+func actors(actor string) (store.Actors, error) {
+	switch actor {
+	case "node":
+		return store.NodeActors, nil
+	case "client":
+		return store.ClientActors, nil
+	}
+	return 0, fmt.Errorf("actor %q should be node or client", actor)
+}
+
+func clockPolicy(conf Config) store.ClockPolicy {
+	return store.ClockPolicy{
+		Strict:     conf.VClockMode == "strict",
+		MaxBytes:   conf.VClockMaxBytes,
+		MaxEntries: conf.VClockMaxEntries,
+	}
+}
 
-	md, err := toml.Decode(string(tomlData), &conf)
+// The settings reload can change, as of the last load
+var live = struct {
+	sync.Mutex
+	conf Config
+}{}
+
+func drainTimeout() time.Duration {
+	live.Lock()
+	defer live.Unlock()
+	return live.conf.DrainTimeout.Duration
+}
+
+// configureLogging sends logs to stderr as the config says, each line naming
+// this node.
+func configureLogging(conf Config) {
+	level, _ := logging.ParseLevel(conf.LogLevel)
+	logging.Configure(os.Stderr, level, conf.LogFormat == "json")
+	logging.Always("node", conf.Name)
+}
+
+// reload re-reads the config file and applies the settings that are safe to
+// change while running: R, W, the timeouts, the users file and the log
+// level. Anything else that changed needs a restart.
+func reload() error {
+	conf, err := LoadConfig(configPath)
 	if err != nil {
-		fmt.Printf("couldn't decode config file: %v", err)
-		os.Exit(1)
+		return err
 	}
 
-	if md.IsDefined("name") == false {
-		conf.Name = uuid.New()
+	live.Lock()
+	defer live.Unlock()
+	old := live.conf
+
+	if conf.N != old.N {
+		return fmt.Errorf("n changed from %d to %d; that needs a restart", old.N, conf.N)
 	}
-	if md.IsDefined("port") == false {
-		conf.Port = 7000
+	if (conf.Users == "") != (old.Users == "") {
+		return errors.New("turning authentication on or off needs a restart")
 	}
-	if md.IsDefined("httpport") == false {
-		conf.HTTPPort = 3000
+	var fresh *auth.Users
+	if users != nil {
+		if fresh, err = auth.LoadUsers(conf.Users); err != nil {
+			return err
+		}
 	}
-	if md.IsDefined("root") == false {
-		usr, _ := user.Current()
-		conf.Root = fmt.Sprintf("%s/mec/%s", usr.HomeDir, conf.Name)
+
+	// everything checks out; a reload that fails must change nothing
+	if err := st.SetQuorum(store.Quorum{N: conf.N, R: conf.R, W: conf.W}); err != nil {
+		return err
+	}
+	pl.SetTimeout(conf.Timeout.Duration)
+	if fresh != nil {
+		users.Replace(fresh)
 	}
+	level, _ := logging.ParseLevel(conf.LogLevel)
+	logging.SetLevel(level)
 
-	return conf
+	old.R, old.W, old.Timeout, old.DrainTimeout, old.Users = conf.R, conf.W, conf.Timeout, conf.DrainTimeout, conf.Users
+	old.LogLevel = conf.LogLevel
+	if !reflect.DeepEqual(old, conf) {
+		log.Warn("reloaded r, w, timeouts, users and log level; other changes need a restart")
+	} else {
+		log.Info("reloaded")
+	}
+	live.conf = old
+	return nil
 }
-
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestApplyEnv(t *testing.T) {
+	env := map[string]string{
+		"MEC_HTTPPORT": "4000",
+		"MEC_ZONE":     "rack-2",
+		"MEC_TIMEOUT":  "500ms",
+		"MEC_NODE":     "10.0.0.1:7000, 10.0.0.2:7000",
+	}
+	lookup := func(k string) (string, bool) {
+		v, ok := env[k]
+		return v, ok
+	}
+
+	conf := defaultConfig()
+	if err := applyEnv(&conf, lookup); err != nil {
+		t.Fatal(err)
+	}
+	switch {
+	case conf.HTTPPort != 4000:
+		t.Error("httpport not overridden:", conf.HTTPPort)
+	case conf.Zone != "rack-2":
+		t.Error("zone not overridden:", conf.Zone)
+	case conf.Timeout.Duration != 500*time.Millisecond:
+		t.Error("timeout not overridden:", conf.Timeout)
+	case len(conf.Node) != 2 || conf.Node[1] != (Node{"10.0.0.2", 7000}):
+		t.Error("nodes not overridden:", conf.Node)
+	case conf.Port != 7000:
+		t.Error("port changed without being set:", conf.Port)
+	}
+
+	env = map[string]string{"MEC_PORT": "seven thousand"}
+	if err := applyEnv(&conf, lookup); err == nil {
+		t.Error("accepted a port that isn't a number")
+	}
+}
+
+func TestValidate(t *testing.T) {
+	good := defaultConfig()
+	good.ClusterPort, good.Root = 7001, "/tmp/mec-test"
+	if err := good.Validate(); err != nil {
+		t.Fatal("default config invalid:", err)
+	}
+
+	good.HTTPBind, good.ClusterBind, good.HTTPAdvertise = "unix:/run/mec.sock", "::", "db1.example.com"
+	if err := good.Validate(); err != nil {
+		t.Fatal("socket and IPv6 binds invalid:", err)
+	}
+
+	bad := map[string]func(*Config){
+		"port out of range":  func(c *Config) { c.Port = 70000 },
+		"ports clash":        func(c *Config) { c.HTTPPort = c.Port },
+		"admin port clash":   func(c *Config) { c.AdminPort = c.HTTPPort },
+		"bind not an IP":     func(c *Config) { c.Bind = "localhost" },
+		"relative socket":    func(c *Config) { c.HTTPBind = "unix:mec.sock" },
+		"advertise port":     func(c *Config) { c.ClusterAdvertise = "db1.example.com:7001" },
+		"advertise any":      func(c *Config) { c.GossipAdvertise = "0.0.0.0" },
+		"node without host":  func(c *Config) { c.Node = []Node{{"", 7000}} },
+		"r bigger than n":    func(c *Config) { c.R = 4 },
+		"zero w":             func(c *Config) { c.W = 0 },
+		"relative root":      func(c *Config) { c.Root = "mec" },
+		"cert without key":   func(c *Config) { c.TLSCert = "/etc/mec/cert.pem" },
+		"no timeout":         func(c *Config) { c.Timeout.Duration = 0 },
+		"no workers":         func(c *Config) { c.Workers = 0 },
+		"unknown actor":      func(c *Config) { c.Actor = "vnode" },
+		"unknown vclockmode": func(c *Config) { c.VClockMode = "loose" },
+		"no vclock entries":  func(c *Config) { c.VClockMaxEntries = 0 },
+	}
+	for name, breakIt := range bad {
+		c := good
+		breakIt(&c)
+		if err := c.Validate(); err == nil {
+			t.Error("accepted config with", name)
+		}
+	}
+}
+
+func TestLoadWithoutName(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mec-config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "config.conf")
+	if err := ioutil.WriteFile(path, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	first, err := LoadConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// as a reload would
+	again, err := LoadConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the default root is named after the node, so it mustn't move either
+	if first.Name == "" || !reflect.DeepEqual(first, again) {
+		t.Errorf("loaded %+v, then %+v", first, again)
+	}
+}
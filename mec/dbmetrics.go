@@ -0,0 +1,31 @@
+package main
+
+import (
+	"fmt"
+	"github.com/cormacrelf/mec-db/metrics"
+	"github.com/cormacrelf/mec-db/store"
+	"strconv"
+)
+
+// LevelDB keeps 7 levels of files
+const leveldbLevels = 7
+
+var (
+	dbFiles = metrics.NewGaugeVec("mec_leveldb_files",
+		"LevelDB table files at each level.", "level")
+	dbSize = metrics.NewGauge("mec_leveldb_approximate_bytes",
+		"Approximate size of every key in LevelDB, on disk.")
+)
+
+// watchDB updates the LevelDB gauges whenever metrics are scraped
+func watchDB(s *store.Store) {
+	metrics.OnScrape(func() {
+		for level := 0; level < leveldbLevels; level++ {
+			v := s.DBProperty(fmt.Sprintf("leveldb.num-files-at-level%d", level))
+			if n, err := strconv.Atoi(v); err == nil {
+				dbFiles.With(strconv.Itoa(level)).Set(float64(n))
+			}
+		}
+		dbSize.Set(float64(s.ApproximateSize()))
+	})
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/cormacrelf/mec-db/api"
+	apierrors "github.com/cormacrelf/mec-db/api/apierrors"
+	"net"
+	"net/http"
+	"net/http/pprof"
+	rpprof "runtime/pprof"
+	"strconv"
+)
+
+// The admin listener is for looking inside a running node: profiles,
+// goroutines, the peers daemon and LevelDB. It has no authentication, so it
+// binds to loopback unless told otherwise.
+
+var adminSrv *http.Server
+
+func adminMux() *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	mux.HandleFunc("/debug/goroutines", dumpGoroutines)
+	mux.HandleFunc("/debug/peers", dumpPeers)
+	mux.HandleFunc("/debug/leveldb", dumpLevelDB)
+	return mux
+}
+
+// every goroutine's stack, as a panic would print them
+func dumpGoroutines(res http.ResponseWriter, req *http.Request) {
+	res.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	rpprof.Lookup("goroutine").WriteTo(res, 2)
+}
+
+func dumpPeers(res http.ResponseWriter, req *http.Request) {
+	b, err := json.MarshalIndent(pl.DaemonState(), "", "  ")
+	if err != nil {
+		api.WriteError(res, req, apierrors.Codify(apierrors.StatusInternalServerError, err))
+		return
+	}
+	res.Header().Set("Content-Type", "application/json")
+	res.Write(b)
+}
+
+// LevelDB's own reports: compactions per level, then every table file
+func dumpLevelDB(res http.ResponseWriter, req *http.Request) {
+	res.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	fmt.Fprintln(res, st.DBProperty("leveldb.stats"))
+	fmt.Fprintln(res, st.DBProperty("leveldb.sstables"))
+	fmt.Fprintf(res, "approximate size: %d bytes\n", st.ApproximateSize())
+}
+
+// serveAdmin runs the admin listener in the background, if one is configured
+func serveAdmin(conf Config) {
+	if conf.AdminPort == 0 {
+		return
+	}
+	addr := net.JoinHostPort(conf.AdminBind, strconv.Itoa(conf.AdminPort))
+	adminSrv = &http.Server{Addr: addr, Handler: adminMux()}
+	go func() {
+		err := adminSrv.ListenAndServe()
+		if err != nil && err != http.ErrServerClosed {
+			log.Error("admin listener failed", "addr", addr, "err", err)
+		}
+	}()
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"crypto/tls"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The client certificate `mec leave` shows a node that wants one
+var (
+	leaveCert = flag.String("cert", "", "client certificate for leave, when tlsclientca is set")
+	leaveKey  = flag.String("key", "", "the client certificate's key")
+)
+
+// leave takes this node out of the cluster without losing anything: it
+// drops out of everyone's ring, stops taking writes, hands every key to
+// its new owners and, if they all took them, leaves memberlist and exits.
+// If some keys weren't taken the node stays up (still refusing writes) so
+// leave can be tried again.
+func leave() (int, int, error) {
+	return leaveWith(nil, nil)
+}
+
+// leaveWith is leave as part of a commit that also lets the joining nodes
+// in and takes the other leaving ones out. Keys go to their owners in the
+// ring as it will be, whether or not the news has reached us yet.
+func leaveWith(joining, leaving []string) (int, int, error) {
+	meta := pl.LocalMeta()
+	meta.Leaving = true
+	pl.SetLocalMeta(meta)
+	list.UpdateNode(time.Second)
+	st.StopWrites()
+
+	sent, failed := st.Handoff(pl.RingWith(joining, append(leaving, pl.Name)))
+	if failed > 0 {
+		return sent, failed, fmt.Errorf("%d keys weren't handed off; not leaving", failed)
+	}
+
+	go func() {
+		// give the response a chance to get out
+		time.Sleep(200 * time.Millisecond)
+		stop(0)
+	}()
+	return sent, failed, nil
+}
+
+// requestLeave is `mec leave`: it asks the node described by the config
+// file to leave, and returns an exit status. An API token for a user with
+// the admin permission can be given in $MEC_TOKEN, and a client
+// certificate with --cert and --key.
+func requestLeave(conf Config) int {
+	scheme := "http"
+	transport := &http.Transport{}
+	if conf.TLSCert != "" {
+		scheme = "https"
+		// it's our own node over loopback; the certificate won't name it
+		transport.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+	}
+	if conf.TLSClientCA != "" {
+		if *leaveCert == "" || *leaveKey == "" {
+			fmt.Println("tlsclientca is set, so the node wants a client certificate: give --cert and --key")
+			return 1
+		}
+		cert, err := tls.LoadX509KeyPair(*leaveCert, *leaveKey)
+		if err != nil {
+			fmt.Printf("couldn't load the client certificate: %v\n", err)
+			return 1
+		}
+		transport.TLSClientConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	host := localHTTP(conf)
+	if strings.HasPrefix(conf.HTTPBind, unixPrefix) {
+		path := strings.TrimPrefix(conf.HTTPBind, unixPrefix)
+		transport.Dial = func(_, _ string) (net.Conn, error) {
+			return net.Dial("unix", path)
+		}
+		host = "localhost"
+	}
+	client := &http.Client{Transport: transport}
+
+	url := fmt.Sprintf("%s://%s/admin/leave", scheme, host)
+	req, err := http.NewRequest("POST", url, nil)
+	if err != nil {
+		fmt.Println(err)
+		return 1
+	}
+	if token := os.Getenv("MEC_TOKEN"); token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	res, err := client.Do(req)
+	if err != nil {
+		fmt.Printf("couldn't reach %s: %v\n", conf.Name, err)
+		return 1
+	}
+	body, _ := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	fmt.Println(string(body))
+	if res.StatusCode != http.StatusOK {
+		return 1
+	}
+	return 0
+}
+
+// localHTTP is host:port for reaching this node's own HTTP listener
+func localHTTP(conf Config) string {
+	host := conf.HTTPBind
+	switch {
+	case host == "" || host == "0.0.0.0":
+		host = "127.0.0.1"
+	case host == "::":
+		host = "::1"
+	}
+	return net.JoinHostPort(host, strconv.Itoa(conf.HTTPPort))
+}
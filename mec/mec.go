@@ -1,71 +1,161 @@
 package main
 
 import (
+	"flag"
 	"fmt"
 	"github.com/codegangsta/martini"
 	"github.com/cormacrelf/mec-db/api"
+	"github.com/cormacrelf/mec-db/auth"
+	"github.com/cormacrelf/mec-db/cluster"
+	"github.com/cormacrelf/mec-db/logging"
+	"github.com/cormacrelf/mec-db/metrics"
 	"github.com/cormacrelf/mec-db/peers"
 	"github.com/cormacrelf/mec-db/store"
+	"github.com/cormacrelf/mec-db/trace"
 	ml "github.com/hashicorp/memberlist"
 	"github.com/jmhodges/levigo"
-	"io/ioutil"
+	"net"
 	"net/http"
+	"os"
 	"runtime"
+	"strconv"
+	"strings"
 	"time"
-	"os"
-	"os/signal"
 )
 
+const Version = "0.1.0"
+
 var m *martini.Martini
 var db *levigo.DB
 var list *ml.Memberlist
 var pl *peers.PeerList
+var st *store.Store
+var srv *http.Server
+var users *auth.Users // nil without authentication
+var started = time.Now()
+var log = logging.With("component", "mec")
 
-func shake(name string, root string) {
+func shake(conf Config) {
 	m = martini.New()
 
 	// Setup middleware
 	m.Use(martini.Recovery())
-	m.Use(martini.Logger())
+	m.Use(trace.Handler())
+	m.Use(logging.Handler())
+	m.Use(api.MapEncoder)
+	m.Use(metrics.Handler())
+	m.Use(auth.Handler(authenticators(conf)...))
+	limiter := api.NewLimiter(conf.MaxRequests)
+	m.Use(api.Limit(limiter))
+	m.Map(limiter)
 
 	// Setup routes
 	r := martini.NewRouter()
-	r.Get(`/mec`, api.GetRoot)
-	r.Get(`/mec/:key`, api.Get)
-	r.Post(`/mec/:key`, api.Post)
-	r.Put(`/mec/:key`, api.Put)
-	r.Delete(`/mec/:key`, api.Delete)
+	r.Get(`/mec`, auth.Require(auth.Admin), api.GetStats)
+	// before /mec/:key, which would match it too. It checks each
+	// operation's permission itself.
+	r.Post(api.BatchPath, api.Batch)
+	r.Get(`/mec/:key`, auth.Require(auth.Read), api.Get)
+	r.Post(`/mec/:key`, auth.Require(auth.Write), api.Post)
+	r.Put(`/mec/:key`, auth.Require(auth.Write), api.Put)
+	r.Delete(`/mec/:key`, auth.Require(auth.Delete), api.Delete)
+	r.Get(`/metrics`, auth.Require(auth.Admin), metrics.Serve)
+	r.Get(`/stats`, auth.Require(auth.Admin), api.GetStats)
+	r.Get(`/admin/peers`, auth.Require(auth.Admin), api.GetPeers)
+	r.Get(`/admin/placement`, auth.Require(auth.Admin), api.GetPlacement)
+	r.Post(`/admin/leave`, auth.Require(auth.Admin), api.Leave)
+	r.Post(`/admin/restart`, auth.Require(auth.Admin), api.Restart)
+	r.Get(`/admin/cluster`, auth.Require(auth.Admin), api.GetCluster)
+	r.Post(`/admin/cluster/join`, auth.Require(auth.Admin), api.JoinCluster)
+	r.Post(`/admin/cluster/leave`, auth.Require(auth.Admin), api.StageLeave)
+	r.Post(`/admin/cluster/replace`, auth.Require(auth.Admin), api.StageReplace)
+	r.Get(`/admin/cluster/plan`, auth.Require(auth.Admin), api.GetPlan)
+	r.Delete(`/admin/cluster/plan`, auth.Require(auth.Admin), api.ClearPlan)
+	r.Post(`/admin/cluster/commit`, auth.Require(auth.Admin), api.CommitPlan)
 	// Add the router action
 	m.Action(r.Handle)
 
 	// Inject database here so we get option parsing
 	opts := levigo.NewOptions()
-	opts.SetCache(levigo.NewLRUCache(3 << 30))
+	opts.SetCache(levigo.NewLRUCache(conf.CacheSize))
 	opts.SetCreateIfMissing(true)
-	db, err := levigo.Open(root, opts)
+	var err error
+	db, err = levigo.Open(conf.Root, opts)
 	if err != nil {
 		panic("failed to create database")
 	}
 
-	s := store.Create(db, pl)
+	st = store.Create(db, pl, store.Quorum{N: conf.N, R: conf.R, W: conf.W},
+		store.Limits{Workers: conf.Workers, Queue: conf.QueueDepth})
+	a, _ := actors(conf.Actor)
+	st.SetActors(a)
+	st.SetClockPolicy(clockPolicy(conf))
+	watchDB(st)
 
 	m.Map(db)
 	m.Map(pl)
-	m.Map(s)
+	m.Map(st)
+	m.Map(api.LeaveFunc(leave))
+	m.Map(cluster.New(pl, list, st))
+	m.Map(api.RestartFunc(restartCluster))
+	m.Map(list)
+	m.Map(api.NodeInfo{Name: conf.Name, Version: Version, Started: started})
 
 }
 
-func joinCluster(name string, port int, nodes []Node) {
+// authenticators are only set up when there is a users file; without one
+// the API is open to anybody who can reach it.
+func authenticators(conf Config) []auth.Authenticator {
+	if conf.Users == "" {
+		return nil
+	}
+	var err error
+	users, err = auth.LoadUsers(conf.Users)
+	if err != nil {
+		panic(err.Error())
+	}
+	auths := []auth.Authenticator{auth.Token(users), auth.Basic(users)}
+	if conf.TLSClientCA != "" {
+		auths = append(auths, auth.Cert(users))
+	}
+	return auths
+}
+
+func joinCluster(conf Config) {
+	name, port, nodes := conf.Name, conf.Port, conf.Node
 	config := ml.DefaultLocalConfig()
 	config.Name = name
-	config.BindAddr = "127.0.0.1"
+	config.BindAddr = conf.GossipBind
+	if config.BindAddr == "" {
+		config.BindAddr = "0.0.0.0"
+	}
 	config.BindPort = port
-	pl = peers.Create(port+1, name)
+	if conf.GossipAdvertise != "" {
+		config.AdvertiseAddr = conf.GossipAdvertise
+		config.AdvertisePort = port
+	}
+	httpPort := conf.HTTPPort
+	if conf.HTTPAdvertise == "" && strings.HasPrefix(conf.HTTPBind, unixPrefix) {
+		// nobody else can reach a unix socket
+		httpPort = 0
+	}
+	pl = peers.Create(name, conf.ClusterBind, peers.Meta{
+		HTTPPort:    httpPort,
+		HTTPHost:    conf.HTTPAdvertise,
+		ClusterPort: conf.ClusterPort,
+		ClusterHost: conf.ClusterAdvertise,
+		Zone:        conf.Zone,
+		Weight:      conf.Weight,
+		Version:     Version,
+	})
+	pl.SetTimeout(conf.Timeout.Duration)
 	ch := make(chan []string, 3)
 	pl.Subscribe(ch, "HELLO")
 	config.Events = pl
-	config.LogOutput = ioutil.Discard
-	list, err := ml.Create(config)
+	config.Delegate = pl
+	config.LogOutput = logging.With("component", "memberlist").Writer()
+	var err error
+	list, err = ml.Create(config)
 	if err != nil {
 		panic("Failed to create memberlist: " + err.Error())
 	}
@@ -90,56 +180,124 @@ func joinCluster(name string, port int, nodes []Node) {
 		}
 	}()
 
-	// Our little fake module that receives HELLO msgs
+	// Tell everyone when our claim on the ring changes
 	go func() {
-		for a := range ch{
-			fmt.Printf("RECEIVED: %v\n", a[1:])
+		for _ = range pl.RingChanges() {
+			list.UpdateNode(time.Second)
 		}
 	}()
 
-}
+	// Orders from a claimant committing a plan
+	go func() {
+		orders := make(chan []string, 10)
+		pl.SubscribeRequests(orders, "CLUSTER")
+		for msg := range orders {
+			if len(msg) < 3 {
+				continue
+			}
+			switch msg[2] {
+			case "activate":
+				meta := pl.LocalMeta()
+				meta.Joining = false
+				pl.SetLocalMeta(meta)
+				pl.Reply(msg[0], "GOOD")
+				list.UpdateNode(time.Second)
+			case "leave":
+				pl.Reply(msg[0], "GOOD")
+				joining, leaving := cluster.ParseLeaveOrder(msg[3:])
+				go func() {
+					if _, _, err := leaveWith(joining, leaving); err != nil {
+						log.Error("leave failed", "err", err)
+					}
+				}()
+			default:
+				pl.Reply(msg[0], "FAIL")
+			}
+		}
+	}()
+
+	// Our little fake module that receives HELLO msgs
+	go func() {
+		for a := range ch {
+			log.Debug("hello", "msg", a[1:])
+		}
+	}()
 
-func shutdown() {
-		db.Close()
-		list.Leave(500 * time.Millisecond)
-		list.Shutdown()
 }
 
 func main() {
 	config := GetConfig()
+	configureLogging(config)
+	configureTracing(config)
 
-	joinCluster(config.Name, config.Port, config.Node)
+	if flag.Arg(0) == "leave" {
+		os.Exit(requestLeave(config))
+	}
+
+	joinCluster(config)
 
 	// m is assigned in shake()
-	shake(config.Name, config.Root)
+	shake(config)
 
-	// Restart cluster on interrupt
-	go func() {
-		c1 := make(chan os.Signal, 1)
-		signal.Notify(c1, os.Interrupt)
-		c2 := make(chan []string, 1)
-		pl.Subscribe(c2, "RESTART")
-		for {
-			select {
-			case _ = <-c1:
-				// sig is a ^C, handle it
-				fmt.Println("\nrestarting...")
-				pl.Broadcast("RESTART")
-				// Wait for the RESTART message to get to everyone
-				time.Sleep(200 * time.Millisecond)
-				os.Exit(2)
-			case _ = <-c2:
-				os.Exit(2)
-			}
-		}
-	}()
+	serveAdmin(config)
 
+	// Stop cleanly on ^C, or when an admin restarts the cluster
+	go handleSignals()
 
 	// http listens on 'serve' port
 	runtime.GOMAXPROCS(runtime.NumCPU())
-	fmt.Println(runtime.GOMAXPROCS(0))
-	err := http.ListenAndServe(fmt.Sprintf(":%d", config.HTTPPort), m)
+	log.Info("starting", "version", Version, "procs", runtime.GOMAXPROCS(0))
+	err := serve(config)
+	if err == http.ErrServerClosed {
+		// shutdown() is draining requests; it exits when it's done
+		select {}
+	}
+	if err != nil {
+		log.Error("failed to create server", "err", err)
+		os.Exit(1)
+	}
+}
+
+// configureTracing starts exporting spans, if the config says where to
+func configureTracing(conf Config) {
+	if conf.Trace == "" {
+		return
+	}
+	exp, err := trace.ParseDestination(conf.Trace)
+	if err != nil {
+		log.Error("tracing is off", "err", err)
+		return
+	}
+	trace.Configure(conf.Name, exp)
+}
+
+// serve runs the HTTP API, over TLS if a certificate is configured.
+func serve(conf Config) error {
+	srv = &http.Server{Handler: m}
+	ln, err := listenHTTP(conf)
+	if err != nil {
+		return err
+	}
+	if conf.TLSCert == "" {
+		return srv.Serve(ln)
+	}
+	tc, err := tlsConfig(conf)
 	if err != nil {
-		fmt.Printf("failed to create server: %v", err)
+		return err
+	}
+	srv.TLSConfig = tc
+	return srv.ServeTLS(ln, conf.TLSCert, conf.TLSKey)
+}
+
+// listenHTTP listens on httpbind:httpport, or on a unix socket if httpbind
+// is unix:/path. A socket left over from a previous run is removed.
+func listenHTTP(conf Config) (net.Listener, error) {
+	if strings.HasPrefix(conf.HTTPBind, unixPrefix) {
+		path := strings.TrimPrefix(conf.HTTPBind, unixPrefix)
+		if fi, err := os.Stat(path); err == nil && fi.Mode()&os.ModeSocket != 0 {
+			os.Remove(path)
+		}
+		return net.Listen("unix", path)
 	}
+	return net.Listen("tcp", net.JoinHostPort(conf.HTTPBind, strconv.Itoa(conf.HTTPPort)))
 }
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"github.com/cormacrelf/mec-db/trace"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Exit status when restarting, so a supervisor knows to start us again
+const restartStatus = 2
+
+var stopping sync.Once
+
+// shutdown drains in-flight HTTP requests, stops answering other nodes,
+// syncs and closes the database, and leaves the cluster.
+func shutdown() {
+	if srv != nil {
+		drain(srv, "http drain")
+	}
+	if adminSrv != nil {
+		// a LevelDB dump mustn't outlive the database
+		drain(adminSrv, "admin drain")
+	}
+	if st != nil {
+		if err := st.Close(); err != nil {
+			log.Error("database sync", "err", err)
+		}
+	}
+	if db != nil {
+		db.Close()
+	}
+	if list != nil {
+		list.Leave(time.Second)
+		list.Shutdown()
+	}
+	trace.Close()
+}
+
+// drain waits for s's running requests to finish, for up to the drain
+// timeout, and closes whatever is left after that
+func drain(s *http.Server, what string) {
+	ctx, cancel := context.WithTimeout(context.Background(), drainTimeout())
+	defer cancel()
+	if err := s.Shutdown(ctx); err != nil {
+		log.Warn(what, "err", err)
+		s.Close()
+	}
+}
+
+// stop shuts down and exits with status. Only the first call does anything;
+// later ones wait for it.
+func stop(status int) {
+	stopping.Do(func() {
+		shutdown()
+		os.Exit(status)
+	})
+	select {}
+}
+
+// handleSignals stops the node on SIGINT or SIGTERM, reloads its config on
+// SIGHUP, and restarts it (by stopping with restartStatus) when an admin
+// restarts the cluster.
+func handleSignals() {
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM, syscall.SIGHUP)
+	restarts := make(chan []string, 1)
+	pl.Subscribe(restarts, "RESTART")
+
+	for {
+		select {
+		case sig := <-sigs:
+			if sig == syscall.SIGHUP {
+				if err := reload(); err != nil {
+					log.Error("reload failed", "err", err)
+				}
+				continue
+			}
+			log.Info("shutting down", "signal", sig)
+			stop(0)
+		case <-restarts:
+			log.Info("restarting")
+			stop(restartStatus)
+		}
+	}
+}
+
+// restartCluster tells every node, this one included, to restart.
+func restartCluster() {
+	pl.Broadcast("RESTART")
+}
@@ -0,0 +1,29 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+)
+
+// tlsConfig builds the HTTP server's TLS settings, requiring and verifying
+// client certificates when a client CA bundle is configured.
+func tlsConfig(conf Config) (*tls.Config, error) {
+	tc := &tls.Config{MinVersion: tls.VersionTLS12}
+	if conf.TLSClientCA == "" {
+		return tc, nil
+	}
+
+	pem, err := ioutil.ReadFile(conf.TLSClientCA)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't read client CA %s: %v", conf.TLSClientCA, err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificates found in %s", conf.TLSClientCA)
+	}
+	tc.ClientCAs = pool
+	tc.ClientAuth = tls.RequireAndVerifyClientCert
+	return tc, nil
+}
@@ -0,0 +1,54 @@
+package metrics
+
+import (
+	"github.com/codegangsta/martini"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	httpRequests = NewCounterVec("mec_http_requests_total",
+		"HTTP requests by method, top-level path and status code.", "method", "path", "code")
+	httpDuration = NewHistogramVec("mec_http_request_duration_seconds",
+		"HTTP request latency by method and top-level path.", DefBuckets, "method", "path")
+	httpInFlight = NewGauge("mec_http_requests_in_flight",
+		"HTTP requests being handled.")
+)
+
+// Handler is martini middleware that counts and times every request.
+func Handler() martini.Handler {
+	return func(c martini.Context, res http.ResponseWriter, req *http.Request) {
+		start := time.Now()
+		httpInFlight.Inc()
+		defer httpInFlight.Dec()
+
+		c.Next()
+
+		path := topLevel(req.URL.Path)
+		code := http.StatusOK
+		if rw, ok := res.(martini.ResponseWriter); ok && rw.Status() != 0 {
+			code = rw.Status()
+		}
+		httpRequests.With(req.Method, path, strconv.Itoa(code)).Inc()
+		httpDuration.With(req.Method, path).ObserveSince(start)
+	}
+}
+
+// topLevel keeps the path label to a handful of values: "/mec", "/admin"
+// and so on, never keys.
+func topLevel(path string) string {
+	parts := strings.SplitN(strings.TrimPrefix(path, "/"), "/", 2)
+	switch parts[0] {
+	case "mec", "admin", "metrics":
+		return "/" + parts[0]
+	}
+	return "other"
+}
+
+// Serve is the handler for GET /metrics
+func Serve(res http.ResponseWriter) {
+	res.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	WritePrometheus(res)
+}
@@ -0,0 +1,353 @@
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Counters, gauges and histograms that are safe to update from any
+// goroutine, written out in Prometheus' text format. Declare them once, at
+// package level, and the registry keeps them:
+//
+//     var writes = metrics.NewCounterVec("mec_writes_total", "Writes by outcome.", "outcome")
+//     writes.With("ok").Inc()
+
+// DefBuckets suit latencies measured in seconds, from 1ms to 10s.
+var DefBuckets = []float64{.001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// a float64 kept in a uint64 so it can be updated atomically
+type atomicFloat struct{ bits uint64 }
+
+func (f *atomicFloat) add(v float64) {
+	for {
+		old := atomic.LoadUint64(&f.bits)
+		next := math.Float64bits(math.Float64frombits(old) + v)
+		if atomic.CompareAndSwapUint64(&f.bits, old, next) {
+			return
+		}
+	}
+}
+
+func (f *atomicFloat) set(v float64) {
+	atomic.StoreUint64(&f.bits, math.Float64bits(v))
+}
+
+func (f *atomicFloat) get() float64 {
+	return math.Float64frombits(atomic.LoadUint64(&f.bits))
+}
+
+// A Counter only goes up.
+type Counter struct{ v atomicFloat }
+
+func (c *Counter) Inc() { c.v.add(1) }
+
+// Add increases the counter by n, which must not be negative.
+func (c *Counter) Add(n float64) {
+	if n < 0 {
+		panic("metrics: counters can't go down")
+	}
+	c.v.add(n)
+}
+
+func (c *Counter) Value() float64 { return c.v.get() }
+
+// A Gauge is a value that goes up and down.
+type Gauge struct{ v atomicFloat }
+
+func (g *Gauge) Set(v float64)  { g.v.set(v) }
+func (g *Gauge) Add(n float64)  { g.v.add(n) }
+func (g *Gauge) Inc()           { g.v.add(1) }
+func (g *Gauge) Dec()           { g.v.add(-1) }
+func (g *Gauge) Value() float64 { return g.v.get() }
+
+// A Histogram counts observations into buckets of upper bounds.
+type Histogram struct {
+	upper  []float64
+	counts []uint64 // per bucket, not cumulative; the last is +Inf
+	count  uint64
+	sum    atomicFloat
+}
+
+func newHistogram(buckets []float64) *Histogram {
+	upper := append([]float64(nil), buckets...)
+	sort.Float64s(upper)
+	return &Histogram{upper: upper, counts: make([]uint64, len(upper)+1)}
+}
+
+func (h *Histogram) Observe(v float64) {
+	i := sort.SearchFloat64s(h.upper, v)
+	atomic.AddUint64(&h.counts[i], 1)
+	atomic.AddUint64(&h.count, 1)
+	h.sum.add(v)
+}
+
+// ObserveSince records the seconds since start, for timing with defer.
+func (h *Histogram) ObserveSince(start time.Time) {
+	h.Observe(time.Since(start).Seconds())
+}
+
+// a family is everything registered under one name: one series per set of
+// label values.
+type family struct {
+	name, help, kind string
+	labels           []string
+	new              func() interface{}
+
+	mu     sync.Mutex
+	series map[string]interface{} // by joined label values
+	values map[string][]string
+}
+
+const labelSep = "\xff"
+
+func (f *family) with(values []string) interface{} {
+	if len(values) != len(f.labels) {
+		panic(fmt.Sprintf("metrics: %s wants %d label values, got %d", f.name, len(f.labels), len(values)))
+	}
+	k := strings.Join(values, labelSep)
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	s, ok := f.series[k]
+	if !ok {
+		s = f.new()
+		f.series[k] = s
+		f.values[k] = append([]string(nil), values...)
+	}
+	return s
+}
+
+var registry = struct {
+	sync.Mutex
+	families map[string]*family
+	scrapes  []func()
+}{families: make(map[string]*family)}
+
+func register(name, help, kind string, labels []string, new func() interface{}) *family {
+	f := &family{
+		name:   name,
+		help:   help,
+		kind:   kind,
+		labels: labels,
+		new:    new,
+		series: make(map[string]interface{}),
+		values: make(map[string][]string),
+	}
+	registry.Lock()
+	defer registry.Unlock()
+	if _, dup := registry.families[name]; dup {
+		panic("metrics: " + name + " registered twice")
+	}
+	registry.families[name] = f
+	return f
+}
+
+// OnScrape runs f before every scrape, to bring gauges that are expensive
+// to keep current (database sizes and the like) up to date.
+func OnScrape(f func()) {
+	registry.Lock()
+	defer registry.Unlock()
+	registry.scrapes = append(registry.scrapes, f)
+}
+
+type CounterVec struct{ f *family }
+type GaugeVec struct{ f *family }
+type HistogramVec struct{ f *family }
+
+func NewCounter(name, help string) *Counter {
+	return NewCounterVec(name, help).With()
+}
+
+func NewCounterVec(name, help string, labels ...string) *CounterVec {
+	return &CounterVec{register(name, help, "counter", labels, func() interface{} { return new(Counter) })}
+}
+
+// With returns the counter for a set of label values, in the order the
+// labels were declared.
+func (v *CounterVec) With(values ...string) *Counter {
+	return v.f.with(values).(*Counter)
+}
+
+func NewGauge(name, help string) *Gauge {
+	return NewGaugeVec(name, help).With()
+}
+
+func NewGaugeVec(name, help string, labels ...string) *GaugeVec {
+	return &GaugeVec{register(name, help, "gauge", labels, func() interface{} { return new(Gauge) })}
+}
+
+func (v *GaugeVec) With(values ...string) *Gauge {
+	return v.f.with(values).(*Gauge)
+}
+
+func NewHistogram(name, help string, buckets []float64) *Histogram {
+	return NewHistogramVec(name, help, buckets).With()
+}
+
+func NewHistogramVec(name, help string, buckets []float64, labels ...string) *HistogramVec {
+	return &HistogramVec{register(name, help, "histogram", labels, func() interface{} { return newHistogram(buckets) })}
+}
+
+func (v *HistogramVec) With(values ...string) *Histogram {
+	return v.f.with(values).(*Histogram)
+}
+
+// Sum adds up the named counter or gauge's series whose label has value,
+// or every series if label is "". It's 0 for metrics that don't exist.
+func Sum(name, label, value string) float64 {
+	registry.Lock()
+	f, ok := registry.families[name]
+	registry.Unlock()
+	if !ok {
+		return 0
+	}
+
+	i := -1
+	for j, l := range f.labels {
+		if l == label {
+			i = j
+		}
+	}
+	if label != "" && i < 0 {
+		return 0
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var total float64
+	for k, s := range f.series {
+		if i >= 0 && f.values[k][i] != value {
+			continue
+		}
+		switch m := s.(type) {
+		case *Counter:
+			total += m.Value()
+		case *Gauge:
+			total += m.Value()
+		}
+	}
+	return total
+}
+
+// WritePrometheus writes every metric in the Prometheus text exposition
+// format, families sorted by name.
+func WritePrometheus(w io.Writer) error {
+	registry.Lock()
+	scrapes := append([]func(){}, registry.scrapes...)
+	fams := make([]*family, 0, len(registry.families))
+	for _, f := range registry.families {
+		fams = append(fams, f)
+	}
+	registry.Unlock()
+
+	for _, f := range scrapes {
+		f()
+	}
+	sort.Sort(byName(fams))
+
+	for _, f := range fams {
+		if err := f.write(w); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (f *family) write(w io.Writer) error {
+	f.mu.Lock()
+	keys := make([]string, 0, len(f.series))
+	for k := range f.series {
+		keys = append(keys, k)
+	}
+	f.mu.Unlock()
+	if len(keys) == 0 {
+		return nil
+	}
+	sort.Strings(keys)
+
+	if _, err := fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", f.name, escapeHelp(f.help), f.name, f.kind); err != nil {
+		return err
+	}
+	for _, k := range keys {
+		f.mu.Lock()
+		s, values := f.series[k], f.values[k]
+		f.mu.Unlock()
+
+		var err error
+		switch m := s.(type) {
+		case *Counter:
+			err = sample(w, f.name, f.labels, values, "", "", m.Value())
+		case *Gauge:
+			err = sample(w, f.name, f.labels, values, "", "", m.Value())
+		case *Histogram:
+			err = m.write(w, f.name, f.labels, values)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (h *Histogram) write(w io.Writer, name string, labels, values []string) error {
+	var cumulative uint64
+	for i, upper := range h.upper {
+		cumulative += atomic.LoadUint64(&h.counts[i])
+		if err := sample(w, name+"_bucket", labels, values, "le", formatFloat(upper), float64(cumulative)); err != nil {
+			return err
+		}
+	}
+	cumulative += atomic.LoadUint64(&h.counts[len(h.upper)])
+	if err := sample(w, name+"_bucket", labels, values, "le", "+Inf", float64(cumulative)); err != nil {
+		return err
+	}
+	if err := sample(w, name+"_sum", labels, values, "", "", h.sum.get()); err != nil {
+		return err
+	}
+	return sample(w, name+"_count", labels, values, "", "", float64(atomic.LoadUint64(&h.count)))
+}
+
+// sample writes one line, with an extra label (a histogram's le) if given
+func sample(w io.Writer, name string, labels, values []string, extra, extraValue string, v float64) error {
+	pairs := make([]string, 0, len(labels)+1)
+	for i, l := range labels {
+		pairs = append(pairs, fmt.Sprintf(`%s="%s"`, l, escapeLabel(values[i])))
+	}
+	if extra != "" {
+		pairs = append(pairs, fmt.Sprintf(`%s="%s"`, extra, extraValue))
+	}
+	if len(pairs) > 0 {
+		name += "{" + strings.Join(pairs, ",") + "}"
+	}
+	_, err := fmt.Fprintf(w, "%s %s\n", name, formatFloat(v))
+	return err
+}
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	}
+	return fmt.Sprint(v)
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+var helpEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+
+func escapeLabel(s string) string { return labelEscaper.Replace(s) }
+func escapeHelp(s string) string  { return helpEscaper.Replace(s) }
+
+type byName []*family
+
+func (b byName) Len() int           { return len(b) }
+func (b byName) Swap(i, j int)      { b[i], b[j] = b[j], b[i] }
+func (b byName) Less(i, j int) bool { return b[i].name < b[j].name }
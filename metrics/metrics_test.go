@@ -0,0 +1,75 @@
+package metrics
+
+import (
+	"bytes"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestConcurrentCounter(t *testing.T) {
+	c := NewCounterVec("test_concurrent_total", "Concurrent increments.", "who")
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 1000; j++ {
+				c.With("a").Inc()
+			}
+		}()
+	}
+	wg.Wait()
+	if v := c.With("a").Value(); v != 8000 {
+		t.Error("counted", v)
+	}
+}
+
+func TestWritePrometheus(t *testing.T) {
+	c := NewCounterVec("test_requests_total", "Requests \"so far\".", "code")
+	c.With("200").Add(3)
+	c.With(`a"b`).Inc()
+	h := NewHistogram("test_latency_seconds", "Latency.", []float64{0.1, 1})
+	h.Observe(0.0625)
+	h.Observe(0.5)
+	h.Observe(5)
+	NewGaugeVec("test_unused", "Never set.", "peer")
+
+	var b bytes.Buffer
+	if err := WritePrometheus(&b); err != nil {
+		t.Fatal(err)
+	}
+	out := b.String()
+	for _, line := range []string{
+		`# TYPE test_requests_total counter`,
+		`test_requests_total{code="200"} 3`,
+		`test_requests_total{code="a\"b"} 1`,
+		`test_latency_seconds_bucket{le="0.1"} 1`,
+		`test_latency_seconds_bucket{le="1"} 2`,
+		`test_latency_seconds_bucket{le="+Inf"} 3`,
+		`test_latency_seconds_sum 5.5625`,
+		`test_latency_seconds_count 3`,
+	} {
+		if !strings.Contains(out, line+"\n") {
+			t.Errorf("missing %q in\n%s", line, out)
+		}
+	}
+	if strings.Contains(out, "test_unused") {
+		t.Error("wrote a family with no series")
+	}
+}
+
+func TestSum(t *testing.T) {
+	c := NewCounterVec("test_sum_total", "Summed.", "method", "code")
+	c.With("GET", "200").Add(2)
+	c.With("GET", "404").Inc()
+	c.With("PUT", "200").Inc()
+	switch {
+	case Sum("test_sum_total", "method", "GET") != 3:
+		t.Error("GETs", Sum("test_sum_total", "method", "GET"))
+	case Sum("test_sum_total", "", "") != 4:
+		t.Error("all", Sum("test_sum_total", "", ""))
+	case Sum("test_sum_total", "peer", "a") != 0 || Sum("test_nothing", "", "") != 0:
+		t.Error("summed something that isn't there")
+	}
+}
@@ -0,0 +1,106 @@
+package peers
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// What the daemon is up to, kept apart from the daemon so a stuck node can
+// still be asked.
+type daemonState struct {
+	sync.Mutex
+	busy       string // what the daemon is doing, or "" when idle
+	since      time.Time
+	recipients []string
+	waiting    map[string]int // callers blocked on the daemon, by call
+}
+
+func newDaemonState() *daemonState {
+	return &daemonState{waiting: make(map[string]int)}
+}
+
+// working records what the daemon has started on; idle clears it.
+func (d *daemonState) working(what string, recipients []string) {
+	d.Lock()
+	defer d.Unlock()
+	d.busy, d.since, d.recipients = what, time.Now(), recipients
+}
+
+func (d *daemonState) idle() {
+	d.working("", nil)
+}
+
+// wait counts a caller until it's done with the daemon:
+//
+//	defer p.debug.wait("multi")()
+func (d *daemonState) wait(call string) func() {
+	d.Lock()
+	d.waiting[call] += 1
+	d.Unlock()
+	return func() {
+		d.Lock()
+		d.waiting[call] -= 1
+		d.Unlock()
+	}
+}
+
+func msgType(msg []string) string {
+	if len(msg) == 0 {
+		return ""
+	}
+	return msg[0]
+}
+
+// A Subscriber is a channel receiving one type of message
+type Subscriber struct {
+	Type     string
+	Buffered int
+	Capacity int
+}
+
+// DaemonState is a snapshot of the peers daemon and everything around it
+type DaemonState struct {
+	Busy        string // empty when idle
+	BusyFor     time.Duration
+	Recipients  []string       // of the message being handled
+	Waiting     map[string]int // callers blocked on the daemon, by call
+	Dealers     map[string]string
+	Subscribers []Subscriber
+	Replies     int // queued for the reply daemon
+}
+
+// DaemonState reports what the daemon is doing without asking the daemon,
+// so it works even if the daemon is stuck.
+func (p PeerList) DaemonState() DaemonState {
+	p.debug.Lock()
+	ds := DaemonState{
+		Busy:       p.debug.busy,
+		Recipients: p.debug.recipients,
+		Waiting:    make(map[string]int, len(p.debug.waiting)),
+	}
+	if ds.Busy != "" {
+		ds.BusyFor = time.Since(p.debug.since)
+	}
+	for call, n := range p.debug.waiting {
+		ds.Waiting[call] = n
+	}
+	p.debug.Unlock()
+
+	ds.Dealers = p.Connected()
+	ds.Replies = len(p.reply)
+
+	subs.Lock()
+	for c, h := range subs.m {
+		ds.Subscribers = append(ds.Subscribers, Subscriber{h.channel, len(c), cap(c)})
+	}
+	subs.Unlock()
+	sort.Sort(byType(ds.Subscribers))
+	return ds
+}
+
+type byType []Subscriber
+
+func (b byType) Len() int           { return len(b) }
+func (b byType) Swap(i, j int)      { b[i], b[j] = b[j], b[i] }
+func (b byType) Less(i, j int) bool { return b[i].Type < b[j].Type }
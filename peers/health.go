@@ -0,0 +1,169 @@
+package peers
+
+import (
+	"encoding/json"
+	"github.com/cormacrelf/mec-db/metrics"
+	"sort"
+	"sync"
+	"time"
+)
+
+// A peer's Health is what we believe about it, from memberlist's gossip and
+// from how its recent requests went.
+type Health int
+
+const (
+	Alive   Health = iota
+	Suspect        // timing out or failing: only used when nobody else will do
+	Down           // left the cluster, or failed so often we stopped asking
+)
+
+const (
+	// consecutive transport failures before a peer is Suspect, then Down
+	SuspectAfter = 2
+	DownAfter    = 5
+	// a peer that is Down from failures alone is retried after this long
+	RetryDownAfter = 10 * time.Second
+	// weight of the latest request in the error rate and latency averages
+	ewmaWeight = 0.2
+)
+
+var healthNames = []string{"alive", "suspect", "down"}
+
+func (h Health) String() string {
+	return healthNames[h]
+}
+
+func (h Health) MarshalJSON() ([]byte, error) {
+	return json.Marshal(h.String())
+}
+
+// PeerHealth is a snapshot of one peer's health record
+type PeerHealth struct {
+	Name      string
+	State     Health
+	Left      bool          // memberlist says it's gone
+	Failures  int           // consecutive
+	ErrorRate float64       // moving average, 0 to 1
+	Latency   time.Duration // moving average round trip
+	LastSeen  time.Time
+	LastError time.Time
+}
+
+var (
+	peerLatency = metrics.NewHistogramVec("mec_peer_latency_seconds",
+		"Round trip of requests to other nodes, by peer.", metrics.DefBuckets, "peer")
+	shed = metrics.NewCounterVec("mec_shed_total",
+		"Messages from other nodes turned away because their queue was full, by type.", "type")
+	peerFailures = metrics.NewCounterVec("mec_peer_failures_total",
+		"Requests to other nodes that timed out or couldn't be sent, by peer.", "peer")
+)
+
+var health = struct {
+	sync.Mutex
+	m map[string]*PeerHealth
+}{m: make(map[string]*PeerHealth)}
+
+func healthOf(name string) *PeerHealth {
+	h := health.m[name]
+	if h == nil {
+		h = &PeerHealth{Name: name}
+		health.m[name] = h
+	}
+	return h
+}
+
+// state works out a peer's Health, letting a peer that was only marked Down
+// for failing have another go once it has rested for RetryDownAfter.
+func (h *PeerHealth) state() Health {
+	if h.State == Down && !h.Left && time.Since(h.LastError) > RetryDownAfter {
+		return Suspect
+	}
+	return h.State
+}
+
+// memberlist saw the node join or change
+func markAlive(name string) {
+	health.Lock()
+	defer health.Unlock()
+	h := healthOf(name)
+	h.State, h.Left, h.Failures = Alive, false, 0
+	h.LastSeen = time.Now()
+}
+
+// memberlist saw the node leave or die
+func markLeft(name string) {
+	health.Lock()
+	defer health.Unlock()
+	h := healthOf(name)
+	h.State, h.Left = Down, true
+}
+
+func recordSuccess(name string, rtt time.Duration) {
+	peerLatency.With(name).Observe(rtt.Seconds())
+	health.Lock()
+	defer health.Unlock()
+	h := healthOf(name)
+	h.Failures = 0
+	h.ErrorRate = (1 - ewmaWeight) * h.ErrorRate
+	if h.Latency == 0 {
+		h.Latency = rtt
+	} else {
+		h.Latency = time.Duration((1-ewmaWeight)*float64(h.Latency) + ewmaWeight*float64(rtt))
+	}
+	h.LastSeen = time.Now()
+	if !h.Left {
+		h.State = Alive
+	}
+}
+
+// recordFailure is for timeouts and socket errors, not FAIL replies: a peer
+// that tells us it doesn't have a key is perfectly healthy.
+func recordFailure(name string) {
+	peerFailures.With(name).Inc()
+	health.Lock()
+	defer health.Unlock()
+	h := healthOf(name)
+	h.Failures += 1
+	h.ErrorRate = (1-ewmaWeight)*h.ErrorRate + ewmaWeight
+	h.LastError = time.Now()
+	switch {
+	case h.Failures >= DownAfter:
+		h.State = Down
+	case h.Failures >= SuspectAfter || h.ErrorRate > 0.5:
+		if h.State == Alive {
+			h.State = Suspect
+		}
+	}
+}
+
+// State returns the named peer's health. Peers we know nothing about are Down.
+func (p PeerList) State(name string) Health {
+	health.Lock()
+	defer health.Unlock()
+	h, ok := health.m[name]
+	if !ok {
+		return Down
+	}
+	return h.state()
+}
+
+// Health returns a snapshot of every peer's health record, by name.
+func (p PeerList) Health() []PeerHealth {
+	health.Lock()
+	defer health.Unlock()
+	acc := make([]PeerHealth, 0, len(health.m))
+	for _, h := range health.m {
+		snap := *h
+		snap.State = h.state()
+		acc = append(acc, snap)
+	}
+	sort.Sort(byName(acc))
+	return acc
+}
+
+type byName []PeerHealth
+
+func (b byName) Len() int           { return len(b) }
+func (b byName) Swap(i, j int)      { b[i], b[j] = b[j], b[i] }
+func (b byName) Less(i, j int) bool { return b[i].Name < b[j].Name }
@@ -0,0 +1,98 @@
+package peers
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func record(name string) PeerHealth {
+	health.Lock()
+	defer health.Unlock()
+	return *health.m[name]
+}
+
+func TestFailureThresholds(t *testing.T) {
+	var p PeerList
+	for _, c := range []struct {
+		failures int
+		want     Health
+	}{
+		{0, Alive},
+		{SuspectAfter - 1, Alive},
+		{SuspectAfter, Suspect},
+		{DownAfter - 1, Suspect},
+		{DownAfter, Down},
+		{DownAfter + 3, Down},
+	} {
+		name := fmt.Sprintf("thresholds-%d", c.failures)
+		markAlive(name)
+		for i := 0; i < c.failures; i++ {
+			recordFailure(name)
+		}
+		if got := p.State(name); got != c.want {
+			t.Errorf("after %d failures: %v, want %v", c.failures, got, c.want)
+		}
+	}
+}
+
+func TestRecovery(t *testing.T) {
+	var p PeerList
+	for _, failures := range []int{SuspectAfter, DownAfter} {
+		name := fmt.Sprintf("recovery-%d", failures)
+		markAlive(name)
+		for i := 0; i < failures; i++ {
+			recordFailure(name)
+		}
+		recordSuccess(name, time.Millisecond)
+		if got := p.State(name); got != Alive {
+			t.Errorf("a success after %d failures left it %v", failures, got)
+		}
+		// the count starts again, though the error rate remembers
+		if h := record(name); h.Failures != 0 || h.ErrorRate == 0 {
+			t.Errorf("after recovering: %+v", h)
+		}
+	}
+
+	// a node that left stays down whatever its sockets say
+	markLeft("recovery-left")
+	recordSuccess("recovery-left", time.Millisecond)
+	if got := p.State("recovery-left"); got != Down {
+		t.Errorf("a node that left is %v", got)
+	}
+}
+
+func TestRetryDown(t *testing.T) {
+	var p PeerList
+	rested := func(name string) {
+		health.Lock()
+		health.m[name].LastError = time.Now().Add(-RetryDownAfter - time.Second)
+		health.Unlock()
+	}
+
+	markAlive("retry-failing")
+	for i := 0; i < DownAfter; i++ {
+		recordFailure("retry-failing")
+	}
+	if got := p.State("retry-failing"); got != Down {
+		t.Fatalf("after %d failures it's %v", DownAfter, got)
+	}
+	rested("retry-failing")
+	if got := p.State("retry-failing"); got != Suspect {
+		t.Errorf("after resting it's %v, want another go as suspect", got)
+	}
+
+	markLeft("retry-left")
+	recordFailure("retry-left")
+	rested("retry-left")
+	if got := p.State("retry-left"); got != Down {
+		t.Errorf("a node that left came back as %v", got)
+	}
+}
+
+func TestUnknownPeerDown(t *testing.T) {
+	var p PeerList
+	if got := p.State("nobody-we-know"); got != Down {
+		t.Errorf("an unknown peer is %v", got)
+	}
+}
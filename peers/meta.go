@@ -0,0 +1,149 @@
+package peers
+
+import (
+	"errors"
+	ml "github.com/hashicorp/memberlist"
+	"github.com/ugorji/go/codec"
+	"net"
+	"reflect"
+	"strconv"
+	"sync"
+)
+
+// Meta is what each node tells the others about itself through memberlist.
+type Meta struct {
+	HTTPPort    int
+	HTTPHost    string // if not the gossip address; HTTPPort is 0 for no TCP listener
+	ClusterPort int    // where its ROUTER listens
+	ClusterHost string // if not the gossip address
+	Zone        string
+	Weight      int // relative capacity
+	Version     string
+	Claim       []int // partitions it owns, as it sees the ring
+	Joining     bool  // waiting for a commit to join the ring
+	Leaving     bool  // handing off its data; not part of the ring
+}
+
+var metas = struct {
+	sync.Mutex
+	m     map[string]Meta
+	hosts map[string]string // where to find their HTTP APIs
+}{m: make(map[string]Meta), hosts: make(map[string]string)}
+
+func encodeMeta(m Meta) ([]byte, error) {
+	var mh codec.MsgpackHandle
+	var b []byte
+	mh.MapType = reflect.TypeOf(m)
+
+	enc := codec.NewEncoderBytes(&b, &mh)
+	err := enc.Encode(m)
+	if err != nil {
+		return nil, errors.New("failed to encode Meta")
+	}
+	return b, nil
+}
+
+func decodeMeta(data []byte) (Meta, error) {
+	var mh codec.MsgpackHandle
+	var m Meta
+	mh.MapType = reflect.TypeOf(m)
+
+	if len(data) == 0 {
+		return Meta{}, errors.New("no metadata")
+	}
+	dec := codec.NewDecoderBytes(data, &mh)
+	err := dec.Decode(&m)
+	if err != nil {
+		return Meta{}, errors.New("Meta not decoded")
+	}
+	return m, nil
+}
+
+// nodeMeta decodes a memberlist node's metadata. Nodes that don't send any
+// get the old convention of a ROUTER on the gossip port + 1.
+func nodeMeta(node *ml.Node) Meta {
+	m, err := decodeMeta(node.Meta)
+	if err != nil {
+		return Meta{ClusterPort: int(node.Port) + 1, Weight: 1}
+	}
+	return m
+}
+
+func (p *PeerList) rememberMeta(node *ml.Node, m Meta) {
+	metas.Lock()
+	defer metas.Unlock()
+	old, known := metas.m[node.Name]
+	metas.m[node.Name] = m
+	metas.hosts[node.Name] = advertised(m.HTTPHost, node)
+	if !known || old.Zone != m.Zone || old.Weight != m.Weight || old.Leaving != m.Leaving || old.Joining != m.Joining {
+		p.rebuildRing()
+	}
+}
+
+func (p *PeerList) forgetMeta(name string) {
+	metas.Lock()
+	defer metas.Unlock()
+	delete(metas.m, name)
+	delete(metas.hosts, name)
+	p.rebuildRing()
+}
+
+// Meta returns what the named peer last advertised about itself
+func (p PeerList) Meta(name string) (Meta, bool) {
+	metas.Lock()
+	defer metas.Unlock()
+	m, ok := metas.m[name]
+	return m, ok
+}
+
+// HTTPAddr returns host:port for the named peer's HTTP API, or "" if the
+// peer hasn't advertised one.
+func (p PeerList) HTTPAddr(name string) string {
+	metas.Lock()
+	defer metas.Unlock()
+	m, ok := metas.m[name]
+	if !ok || m.HTTPPort == 0 {
+		return ""
+	}
+	return net.JoinHostPort(metas.hosts[name], strconv.Itoa(m.HTTPPort))
+}
+
+// memberlist Delegate: we only use it to gossip our Meta.
+
+func (p *PeerList) NodeMeta(limit int) []byte {
+	p.metamutex.Lock()
+	local := p.local
+	p.metamutex.Unlock()
+
+	b, err := encodeMeta(local)
+	if err == nil && len(b) > limit {
+		// the claim is the only part that can grow; peers can work it out
+		local.Claim = nil
+		b, err = encodeMeta(local)
+	}
+	if err != nil || len(b) > limit {
+		log.Error("can't fit node metadata", "limit", limit)
+		return nil
+	}
+	return b
+}
+
+func (p *PeerList) NotifyMsg([]byte)                           {}
+func (p *PeerList) GetBroadcasts(overhead, limit int) [][]byte { return nil }
+func (p *PeerList) LocalState(join bool) []byte                { return nil }
+func (p *PeerList) MergeRemoteState(buf []byte, join bool)     {}
+
+// LocalMeta returns what this node advertises about itself
+func (p *PeerList) LocalMeta() Meta {
+	p.metamutex.Lock()
+	defer p.metamutex.Unlock()
+	return p.local
+}
+
+// SetLocalMeta changes what this node advertises. Call memberlist's
+// UpdateNode afterwards to spread the news.
+func (p *PeerList) SetLocalMeta(m Meta) {
+	p.metamutex.Lock()
+	defer p.metamutex.Unlock()
+	p.local = m
+}
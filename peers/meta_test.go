@@ -0,0 +1,59 @@
+package peers
+
+import (
+	ml "github.com/hashicorp/memberlist"
+	"reflect"
+	"sync"
+	"testing"
+)
+
+var someMeta = Meta{
+	HTTPPort: 3000, HTTPHost: "10.0.0.1", ClusterPort: 7001, Zone: "rack-a",
+	Weight: 2, Version: "0.1.0", Claim: []int{1, 5, 9}, Leaving: true,
+}
+
+func TestMetaRoundTrip(t *testing.T) {
+	b, err := encodeMeta(someMeta)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := nodeMeta(&ml.Node{Name: "b1", Port: 7000, Meta: b})
+	if !reflect.DeepEqual(m, someMeta) {
+		t.Errorf("got %+v", m)
+	}
+}
+
+func TestMetaFallback(t *testing.T) {
+	// nodes from before metadata, and ones sending something we can't read
+	for _, data := range [][]byte{nil, {0xc1, 0xff, 0x00}} {
+		m := nodeMeta(&ml.Node{Name: "b1", Port: 7000, Meta: data})
+		if m.ClusterPort != 7001 || m.Weight != 1 || m.Zone != "" {
+			t.Errorf("%x: got %+v", data, m)
+		}
+	}
+}
+
+func TestMetaLimit(t *testing.T) {
+	big := someMeta
+	big.Claim = make([]int, 256)
+	for i := range big.Claim {
+		big.Claim[i] = 1000 + i
+	}
+	p := &PeerList{local: big, metamutex: &sync.Mutex{}}
+	full, _ := encodeMeta(big)
+	small := big
+	small.Claim = nil
+	least, _ := encodeMeta(small)
+
+	if b := p.NodeMeta(len(full)); len(b) != len(full) {
+		t.Errorf("with room for it all, sent %d bytes of %d", len(b), len(full))
+	}
+	// the claim goes first
+	b := p.NodeMeta(len(least))
+	if m, err := decodeMeta(b); err != nil || m.Claim != nil || m.Zone != "rack-a" {
+		t.Errorf("without room for the claim, sent %+v, %v", m, err)
+	}
+	if b := p.NodeMeta(len(least) - 1); b != nil {
+		t.Errorf("without room for anything, sent %d bytes", len(b))
+	}
+}
@@ -2,15 +2,26 @@ package peers
 
 import (
 	"fmt"
+	"github.com/cormacrelf/mec-db/logging"
+	"github.com/cormacrelf/mec-db/trace"
 	ml "github.com/hashicorp/memberlist"
 	zmq "github.com/pebbe/zmq4"
 	"math/rand"
+	"net"
+	"strconv"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
+// How long to wait for replies unless told otherwise
+const DefaultTimeout = 2 * time.Second
+
+var log = logging.With("component", "peers")
+
 var dealmutex = sync.Mutex{}
 var dealers map[string]*zmq.Socket
+var addrs map[string]string // for reconnecting dealers
 
 var subs struct {
 	sync.Mutex
@@ -18,7 +29,8 @@ var subs struct {
 }
 
 type handler struct {
-	channel string
+	channel  string
+	requests bool // senders wait for a reply; see SubscribeRequests
 }
 
 func (h *handler) want(ch string) bool {
@@ -27,29 +39,75 @@ func (h *handler) want(ch string) bool {
 
 type PeerList struct {
 	ml.EventDelegate
-	Name   string
-	router *zmq.Socket
-	rep1   *zmq.Socket
-	rep2   *zmq.Socket
+	Name    string
+	timeout *int64 // nanoseconds, see Timeout
+	// what we gossip about ourselves
+	local     Meta
+	metamutex *sync.Mutex
+	span      *trace.Span     // see WithSpan
+	reqlog    *logging.Logger // see WithLog
+	debug     *daemonState
+	ringch    chan struct{}
+	router    *zmq.Socket
+	rep1      *zmq.Socket
+	rep2      *zmq.Socket
 	// pseudo-methods for daemon
 	send      chan []string
 	expect    chan *Expecter
 	sendmulti chan MultiSender
 	reply     chan []string
 	broadcast chan []string
+	redial    *redials
+}
+
+// redials are the peers whose ROUTERs have moved, waiting for the daemon
+// to swap their dealers. Only the latest address for each counts, and
+// adding one never waits for the daemon.
+type redials struct {
+	sync.Mutex
+	m     map[string]string
+	ready chan struct{}
+}
+
+func newRedials() *redials {
+	return &redials{m: make(map[string]string), ready: make(chan struct{}, 1)}
+}
+
+func (r *redials) add(name, addr string) {
+	r.Lock()
+	r.m[name] = addr
+	r.Unlock()
+	select {
+	case r.ready <- struct{}{}:
+	default:
+		// the daemon has been told already
+	}
+}
+
+// take empties the waiting list
+func (r *redials) take() map[string]string {
+	r.Lock()
+	defer r.Unlock()
+	m := r.m
+	r.m = make(map[string]string)
+	return m
 }
 
-// Create returns a new `*PeerList` initialised with its own
-// ROUTER socket
-func Create(port int, name string) *PeerList {
+// Create returns a new `*PeerList` initialised with its own ROUTER socket
+// on bind:local.ClusterPort. An empty bind means all interfaces.
+func Create(name string, bind string, local Meta) *PeerList {
 	r, err := zmq.NewSocket(zmq.ROUTER)
 	if err != nil {
 		panic("Can't create ROUTER socket")
 	}
-	addr := fmt.Sprintf("tcp://*:%d", port)
+	if bind == "" || bind == "0.0.0.0" || bind == "::" {
+		bind = "*"
+	}
+	r.SetIpv6(true)
+	addr := tcpAddr(bind, local.ClusterPort)
 	err = r.Bind(addr)
 	if err != nil {
-		panic(fmt.Sprintf("Can't bind router on port %d", port))
+		panic(fmt.Sprintf("Can't bind router on %s", addr))
 	}
 
 	rep, err := zmq.NewSocket(zmq.PAIR)
@@ -59,7 +117,7 @@ func Create(port int, name string) *PeerList {
 	addr = "inproc://reply"
 	err = rep.Bind(addr)
 	if err != nil {
-		panic(fmt.Sprintf("Can't bind PAIR on ", addr))
+		panic(fmt.Sprintf("Can't bind PAIR on %s", addr))
 	}
 
 	reper, err := zmq.NewSocket(zmq.PAIR)
@@ -69,11 +127,16 @@ func Create(port int, name string) *PeerList {
 	addr = "inproc://reply"
 	err = reper.Connect(addr)
 	if err != nil {
-		panic(fmt.Sprintf("Can't connect PAIR to ", addr))
+		panic(fmt.Sprintf("Can't connect PAIR to %s", addr))
 	}
 
 	pl := &PeerList{
 		Name:      name,
+		timeout:   new(int64),
+		local:     local,
+		metamutex: &sync.Mutex{},
+		ringch:    make(chan struct{}, 1),
+		debug:     newDaemonState(),
 		router:    r,
 		rep1:      rep,
 		rep2:      reper,
@@ -82,9 +145,13 @@ func Create(port int, name string) *PeerList {
 		sendmulti: make(chan MultiSender),
 		reply:     make(chan []string),
 		broadcast: make(chan []string),
+		redial:    newRedials(),
 	}
 
+	pl.SetTimeout(DefaultTimeout)
+
 	dealers = make(map[string]*zmq.Socket, 100)
+	addrs = make(map[string]string, 100)
 
 	go pl.runrouter()
 	go pl.daemon(pl.send, pl.expect, pl.sendmulti, pl.broadcast)
@@ -93,39 +160,152 @@ func Create(port int, name string) *PeerList {
 	return pl
 }
 
+// Timeout is how long to wait for replies unless told otherwise
+func (p PeerList) Timeout() time.Duration {
+	return time.Duration(atomic.LoadInt64(p.timeout))
+}
+
+func (p PeerList) SetTimeout(d time.Duration) {
+	atomic.StoreInt64(p.timeout, int64(d))
+}
+
 // Add an interface to any new node's ROUTER to our knowledge
 func (p *PeerList) NotifyJoin(node *ml.Node) {
 	if p.Name != node.Name {
-		fmt.Printf("JOINED: %v, %v:%d\n", node.Name, node.Addr, node.Port)
+		log.Info("joined", "peer", node.Name, "addr", net.JoinHostPort(node.Addr.String(), strconv.Itoa(int(node.Port))))
 	}
+	meta := nodeMeta(node)
+	addr := tcpAddr(advertised(meta.ClusterHost, node), meta.ClusterPort)
+	sock := connectDealer(addr)
+
+	dealmutex.Lock()
+	dealers[node.Name] = sock
+	addrs[node.Name] = addr
+	dealmutex.Unlock()
+	markAlive(node.Name)
+	p.rememberMeta(node, meta)
+	// (*p).Message(node.Name, "HELLO")
+
+}
+
+// Delete a leaving node's interface
+func (p *PeerList) NotifyLeave(node *ml.Node) {
+	log.Info("left", "peer", node.Name, "addr", net.JoinHostPort(node.Addr.String(), strconv.Itoa(int(node.Port))))
+	markLeft(node.Name)
+	p.forgetMeta(node.Name)
+	defer dealmutex.Unlock()
+	dealmutex.Lock()
+	delete(dealers, node.Name)
+	delete(addrs, node.Name)
+}
+
+// A node we already know about has changed its metadata, and it's alive,
+// at least. If it has moved its ROUTER we need a new dealer.
+func (p *PeerList) NotifyUpdate(node *ml.Node) {
+	meta := nodeMeta(node)
+	p.rememberMeta(node, meta)
+	markAlive(node.Name)
+
+	addr := tcpAddr(advertised(meta.ClusterHost, node), meta.ClusterPort)
+	dealmutex.Lock()
+	moved := addrs[node.Name] != addr
+	dealmutex.Unlock()
+	if moved {
+		// the daemon may be using the old one, so it does the swap. We're
+		// in memberlist's callback and mustn't hold it up.
+		p.redial.add(node.Name, addr)
+	}
+}
+
+// tcpAddr is a ZeroMQ endpoint, with brackets around IPv6 addresses
+func tcpAddr(host string, port int) string {
+	return "tcp://" + net.JoinHostPort(host, strconv.Itoa(port))
+}
+
+// advertised is the host a peer asked to be reached on, or failing that
+// the address memberlist knows it by.
+func advertised(host string, node *ml.Node) string {
+	if host != "" {
+		return host
+	}
+	return node.Addr.String()
+}
+
+func connectDealer(addr string) *zmq.Socket {
 	sock, err := zmq.NewSocket(zmq.DEALER)
 	if err != nil {
 		panic("Can't create DEALER socket")
 	}
-
-	addr := fmt.Sprintf("tcp://%s:%d", node.Addr.String(), node.Port+1)
+	sock.SetLinger(0)
+	sock.SetIpv6(true)
 	err = sock.Connect(addr)
 	if err != nil {
 		panic(fmt.Sprintf("Can't connect to router at %s", addr))
 	}
+	return sock
+}
+
+// Connected maps each peer we have a dealer for to its ROUTER's address
+func (p PeerList) Connected() map[string]string {
 	defer dealmutex.Unlock()
 	dealmutex.Lock()
-	dealers[node.Name] = sock
-	// (*p).Message(node.Name, "HELLO")
+	acc := make(map[string]string, len(addrs))
+	for name, addr := range addrs {
+		acc[name] = addr
+	}
+	return acc
+}
 
+func dealer(name string) *zmq.Socket {
+	defer dealmutex.Unlock()
+	dealmutex.Lock()
+	return dealers[name]
 }
 
-// Delete a leaving node's interface
-func (p *PeerList) NotifyLeave(node *ml.Node) {
-	fmt.Printf("LEFT:   %v, %v:%d\n", node.Name, node.Addr, node.Port)
+// reconnect swaps a peer's dealer for a fresh one, so a reply that turns up
+// after we stopped waiting for it can't be mistaken for the next one.
+// Only the daemon uses dealers, so only the daemon may call this.
+func reconnect(name string) {
 	defer dealmutex.Unlock()
 	dealmutex.Lock()
-	delete(dealers, node.Name)
+	old, ok := dealers[name]
+	if !ok {
+		return
+	}
+	dealers[name] = connectDealer(addrs[name])
+	old.Close()
+}
+
+// redial moves a peer's dealer to a new address, closing the old one. Like
+// reconnect, only the daemon may call it.
+func redial(name, addr string) {
+	defer dealmutex.Unlock()
+	dealmutex.Lock()
+	old, ok := dealers[name]
+	if !ok {
+		// it has left since
+		return
+	}
+	dealers[name] = connectDealer(addr)
+	addrs[name] = addr
+	old.Close()
 }
 
 // Subscribes sender to a msgtype (eg WRITE): returns a chan through
-// which all such messages will be forwarded.
+// which all such messages will be forwarded. Messages that arrive while c
+// is full are dropped, so give it a buffer.
 func (p *PeerList) Subscribe(c chan []string, msgtype string) {
+	p.subscribe(c, msgtype, false)
+}
+
+// SubscribeRequests is Subscribe for messages whose senders wait for a
+// reply. When c is full the sender is told BUSY straight away rather than
+// left to time out, and c's buffer is how many may queue.
+func (p *PeerList) SubscribeRequests(c chan []string, msgtype string) {
+	p.subscribe(c, msgtype, true)
+}
+
+func (p *PeerList) subscribe(c chan []string, msgtype string, requests bool) {
 	if c == nil {
 		panic("Nil channel subscription.")
 	}
@@ -143,6 +323,14 @@ func (p *PeerList) Subscribe(c chan []string, msgtype string) {
 	}
 
 	h.channel = msgtype
+	h.requests = requests
+}
+
+// Unsubscribe stops forwarding messages to c
+func (p *PeerList) Unsubscribe(c chan []string) {
+	subs.Lock()
+	defer subs.Unlock()
+	delete(subs.m, c)
 }
 
 // res := make(chan []string)
@@ -156,59 +344,143 @@ func (p *PeerList) Subscribe(c chan []string, msgtype string) {
 type Expecter chan []string
 type MultiSender struct {
 	msg, recipients []string
+	timeout         time.Duration
+	span            *trace.Span
+	log             *logging.Logger
 	res             *chan map[string][]string
 }
 
 // daemon() isolates contact with zmq.Sockets to one goroutine
 func (p *PeerList) daemon(send chan []string, expect chan *Expecter, sendmulti chan MultiSender, broadcast chan []string) {
 	for {
+		p.debug.idle()
 		select {
 		case e := <-send:
 			// format: [dest msg...]
 			recipient := e[0]
-			dest := dealers[recipient]
+			p.debug.working("send "+msgType(e[1:]), e[:1])
+			dest := dealer(recipient)
+			if dest == nil {
+				continue
+			}
 			_, err := dest.SendMessage(e[1:])
 			if err != nil {
-				fmt.Printf("dealer send error %v\n", err)
+				log.Warn("dealer send error", "peer", recipient, "err", err)
+				recordFailure(recipient)
 			}
 		case e := <-expect:
 			// format: [dest msg...]
 			msg := <-*e
 			recipient := msg[0]
-			dest := dealers[recipient]
-			_, err := dest.SendMessage(msg[1:])
-			if err != nil {
-				fmt.Printf("dealer send error %v\n", err)
-			}
-			res, err := dest.RecvMessage(0)
-			*e <- res
+			p.debug.working("expect "+msgType(msg[1:]), msg[:1])
+			acc := exchange([]string{recipient}, msg[1:], p.Timeout(), nil, log)
+			*e <- acc[recipient]
 		case args := <-sendmulti:
 			// format: [dest: msg, dest2: msg2]
-			acc := make(map[string][]string, len(args.recipients))
-			for _, r := range args.recipients {
-				remote := dealers[r]
-				remote.SendMessage(args.msg)
+			p.debug.working("multi "+msgType(args.msg), args.recipients)
+			*args.res <- exchange(args.recipients, args.msg, args.timeout, args.span, args.log)
+		case <-p.redial.ready:
+			for name, addr := range p.redial.take() {
+				p.debug.working("redial", []string{name})
+				redial(name, addr)
 			}
-			for _, r := range args.recipients {
-				remote := dealers[r]
-				msg, err := remote.RecvMessage(0)
-				if err == nil {
-					acc[r] = msg
-				}
-			}
-			*args.res <- acc
 		case msg := <-broadcast:
-			for k, _ := range dealers {
-				dest := dealers[k]
+			p.debug.working("broadcast "+msgType(msg), nil)
+			dealmutex.Lock()
+			all := make([]*zmq.Socket, 0, len(dealers))
+			for _, dest := range dealers {
+				all = append(all, dest)
+			}
+			dealmutex.Unlock()
+			for _, dest := range all {
 				_, err := dest.SendMessage(msg)
 				if err != nil {
-					fmt.Printf("dealer send error %v\n", err)
+					log.Warn("dealer send error", "msg", msg[0], "err", err)
 				}
 			}
 		}
 	}
 }
 
+// exchange sends msg to every recipient and collects the replies that arrive
+// within timeout, keeping each peer's health up to date as it goes. With a
+// span, each round trip gets a span of its own, which the message carries
+// so the recipient can add to the trace. Trouble with a peer is logged to l.
+func exchange(recipients, msg []string, timeout time.Duration, sp *trace.Span, l *logging.Logger) map[string][]string {
+	acc := make(map[string][]string, len(recipients))
+	waiting := make(map[*zmq.Socket]string, len(recipients))
+	trips := make(map[string]*trace.Span, len(recipients))
+	poller := zmq.NewPoller()
+	start := time.Now()
+
+	for _, r := range recipients {
+		remote := dealer(r)
+		if remote == nil {
+			continue
+		}
+		trip := sp.Child(msg[0]+" "+r, trace.Client)
+		trip.Set("peer", r)
+		_, err := remote.SendMessage(append(msg[:len(msg):len(msg)], trip.Frame()...))
+		if err != nil {
+			l.Warn("dealer send error", "peer", r, "msg", msg[0], "err", err)
+			recordFailure(r)
+			trip.Fail(err.Error())
+			trip.End()
+			continue
+		}
+		waiting[remote] = r
+		trips[r] = trip
+		poller.Add(remote, zmq.POLLIN)
+	}
+
+	deadline := start.Add(timeout)
+	for len(waiting) > 0 {
+		remaining := deadline.Sub(time.Now())
+		if remaining <= 0 {
+			break
+		}
+		polled, err := poller.Poll(remaining)
+		if err != nil || len(polled) == 0 {
+			break
+		}
+		for _, ready := range polled {
+			r, ok := waiting[ready.Socket]
+			if !ok {
+				// already answered; throw away anything else it says
+				ready.Socket.RecvMessage(zmq.DONTWAIT)
+				continue
+			}
+			delete(waiting, ready.Socket)
+			reply, err := ready.Socket.RecvMessage(0)
+			if err != nil {
+				l.Warn("dealer receive error", "peer", r, "msg", msg[0], "err", err)
+				recordFailure(r)
+				reconnect(r)
+				trips[r].Fail(err.Error())
+				trips[r].End()
+				continue
+			}
+			recordSuccess(r, time.Since(start))
+			acc[r] = reply
+			if len(reply) > 0 {
+				trips[r].Set("reply", reply[0])
+			}
+			trips[r].End()
+		}
+	}
+
+	// whoever is left timed out
+	for _, r := range waiting {
+		l.Debug("no reply", "peer", r, "msg", msg[0], "timeout", timeout)
+		recordFailure(r)
+		reconnect(r)
+		trips[r].Fail("timed out")
+		trips[r].End()
+	}
+
+	return acc
+}
+
 // wrap the router communication PAIR in a familiar chan
 func (p *PeerList) replydaemon(reply chan []string) {
 	for {
@@ -217,7 +489,7 @@ func (p *PeerList) replydaemon(reply chan []string) {
 			// format: [router_data msg]
 			_, err := p.rep1.SendMessage(msg)
 			if err != nil {
-				fmt.Printf("router reply error %v\n", err)
+				log.Warn("router reply error", "err", err)
 			}
 		}
 	}
@@ -236,7 +508,7 @@ func (p PeerList) runrouter() {
 			case p.router:
 				data, err := p.router.RecvMessage(0)
 				if err != nil {
-					fmt.Printf("router err %v\n", err)
+					log.Warn("router receive error", "err", err)
 					time.Sleep(100 * time.Millisecond)
 					continue
 				}
@@ -245,41 +517,73 @@ func (p PeerList) runrouter() {
 					continue
 				}
 				msgtype := data[1]
-				subs.Lock()
-
-				for c, h := range subs.m {
-					if h.want(msgtype) {
-						c <- data
+				if !p.deliver(msgtype, data) {
+					shed.With(msgtype).Inc()
+					if _, err := p.router.SendMessage(data[0], "BUSY"); err != nil {
+						log.Warn("couldn't send reply", "err", err)
 					}
 				}
-
-				subs.Unlock()
 			case p.rep2:
 				msg, err := s.RecvMessage(0)
 				if err != nil {
-					fmt.Println("couldn't receive")
+					log.Warn("couldn't receive reply", "err", err)
 				}
 				_, err = p.router.SendMessage(msg)
 				if err != nil {
-					fmt.Println("couldn't send\n")
+					log.Warn("couldn't send reply", "err", err)
 				}
 			}
 		}
 	}
 }
 
+// deliver hands a message to its subscribers without waiting for any of
+// them, so one slow subscriber can't hold up the router for everyone. It
+// returns false if a subscriber expecting requests was too full to take it.
+func (p PeerList) deliver(msgtype string, data []string) bool {
+	subs.Lock()
+	defer subs.Unlock()
+	ok := true
+	for c, h := range subs.m {
+		if !h.want(msgtype) {
+			continue
+		}
+		select {
+		case c <- data:
+		default:
+			if h.requests {
+				ok = false
+			} else {
+				shed.With(msgtype).Inc()
+				log.Warn("subscriber full; dropped message", "msg", msgtype)
+			}
+		}
+	}
+	return ok
+}
+
+// Shed counts a message turned away after delivery, because whatever
+// handles it was too busy
+func Shed(msgtype string) {
+	shed.With(msgtype).Inc()
+}
+
 func (p PeerList) Reply(msg ...string) {
+	defer p.debug.wait("reply")()
 	p.reply <- msg
 }
 
 // Send one message to a named recipient
 func (p PeerList) Message(recipient string, msg ...string) error {
+	defer p.debug.wait("send")()
 	p.send <- append([]string{recipient}, msg...)
 	return nil
 }
 
-// Send one message and await reply string
-func (p PeerList) MessageExpectResponse(recipient string, msg ...string) ([]string) {
+// Send one message and await reply string, which is empty if the recipient
+// didn't reply within p.Timeout()
+func (p PeerList) MessageExpectResponse(recipient string, msg ...string) []string {
+	defer p.debug.wait("expect")()
 	res := make(Expecter)
 	p.expect <- &res
 	res <- append([]string{recipient}, msg...)
@@ -289,23 +593,55 @@ func (p PeerList) MessageExpectResponse(recipient string, msg ...string) ([]stri
 
 // Send multiple messages and await replies with a global timeout
 func (p PeerList) MultiMessageExpectResponse(recipients []string, timeout time.Duration, msg ...string) map[string][]string {
+	defer p.debug.wait("multi")()
 	res := make(chan map[string][]string)
-	p.sendmulti <- MultiSender{msg, recipients, &res}
+	l := log
+	if p.reqlog != nil {
+		l = p.reqlog.With("component", "peers")
+	}
+	p.sendmulti <- MultiSender{msg, recipients, timeout, p.span, l, &res}
 	return <-res
 }
 
+// WithSpan returns a PeerList whose MultiMessageExpectResponse and VerifyAll
+// record their round trips as children of sp and pass the trace on.
+func (p PeerList) WithSpan(sp *trace.Span) *PeerList {
+	p.span = sp
+	return &p
+}
+
+// WithLog returns a PeerList whose MultiMessageExpectResponse and VerifyAll
+// log trouble with peers with l's fields, eg the request and key they're for.
+func (p PeerList) WithLog(l *logging.Logger) *PeerList {
+	p.reqlog = l
+	return &p
+}
+
+// RandomNodes shuffles the peers that aren't Down, putting the Alive ones
+// first so a Suspect peer is only asked when there's nobody better.
 func (p PeerList) RandomNodes() ([]string, int) {
-	defer dealmutex.Unlock()
 	dealmutex.Lock()
 	slice := make([]string, 0)
 	for k, _ := range dealers {
 		slice = append(slice, k)
 	}
+	dealmutex.Unlock()
 	for i := range slice {
 		j := rand.Intn(i + 1)
 		slice[i], slice[j] = slice[j], slice[i]
 	}
 
+	alive, suspect := make([]string, 0, len(slice)), make([]string, 0)
+	for _, k := range slice {
+		switch p.State(k) {
+		case Alive:
+			alive = append(alive, k)
+		case Suspect:
+			suspect = append(suspect, k)
+		}
+	}
+	slice = append(alive, suspect...)
+
 	return slice, len(slice)
 }
 
@@ -356,15 +692,14 @@ func (p PeerList) RandomResponses(n int, msg ...string) (map[string][]string, in
 		n = t
 	}
 
-	res := make(chan map[string][]string)
-	p.sendmulti <- MultiSender{msg, slice[:n], &res}
-	responses := <-res
+	responses := p.MultiMessageExpectResponse(slice[:n], p.Timeout(), msg...)
 
 	// len(responses) <= n <= number of available clients
 	return responses, len(responses)
 }
 
 func (p PeerList) Broadcast(msg ...string) int {
+	defer p.debug.wait("broadcast")()
 	p.broadcast <- msg
 	return 0
 }
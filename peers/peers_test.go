@@ -0,0 +1,58 @@
+package peers
+
+import "testing"
+
+func TestDeliverWhenFull(t *testing.T) {
+	var p PeerList
+	reqs, plain := make(chan []string, 1), make(chan []string, 1)
+	p.SubscribeRequests(reqs, "WRITE")
+	p.Subscribe(plain, "HELLO")
+	defer p.Unsubscribe(reqs)
+	defer p.Unsubscribe(plain)
+
+	if !p.deliver("WRITE", []string{"id", "WRITE", "a"}) {
+		t.Fatal("a request subscriber with room turned a request away")
+	}
+	// the sender gets BUSY for this one
+	if p.deliver("WRITE", []string{"id", "WRITE", "b"}) {
+		t.Error("a full request subscriber took another request")
+	}
+	if msg := <-reqs; msg[2] != "a" {
+		t.Errorf("request subscriber got %v", msg)
+	}
+
+	// a plain subscriber just misses out
+	for _, body := range []string{"a", "b"} {
+		if !p.deliver("HELLO", []string{"id", "HELLO", body}) {
+			t.Errorf("HELLO %s was refused", body)
+		}
+	}
+	if len(plain) != 1 {
+		t.Fatalf("plain subscriber has %d messages", len(plain))
+	}
+	if msg := <-plain; msg[2] != "a" {
+		t.Errorf("plain subscriber got %v", msg)
+	}
+}
+
+func TestRedialsCoalesce(t *testing.T) {
+	r := newRedials()
+	// none of these may wait for the daemon
+	r.add("b1", "tcp://10.0.0.1:7001")
+	r.add("b1", "tcp://10.0.0.2:7001")
+	r.add("b2", "tcp://10.0.0.3:7001")
+
+	<-r.ready
+	select {
+	case <-r.ready:
+		t.Error("the daemon was told more than once")
+	default:
+	}
+	got := r.take()
+	if len(got) != 2 || got["b1"] != "tcp://10.0.0.2:7001" || got["b2"] != "tcp://10.0.0.3:7001" {
+		t.Errorf("got %v", got)
+	}
+	if left := r.take(); len(left) != 0 {
+		t.Errorf("left behind %v", left)
+	}
+}
@@ -0,0 +1,116 @@
+package peers
+
+import (
+	"github.com/cormacrelf/mec-db/ring"
+)
+
+// The ring is rebuilt from everybody's Meta whenever membership changes.
+
+var current = ring.New(nil)
+
+// ringWithout builds a ring from every member that isn't joining or
+// leaving and isn't named in exclude. It must be called with metas locked.
+func ringWithout(exclude ...string) *ring.Ring {
+	return ringOf(exclude, nil)
+}
+
+// ringOf is ringWithout, but also including the members named in include
+// whether they're joining or not
+func ringOf(exclude, include []string) *ring.Ring {
+	members := make([]ring.Member, 0, len(metas.m))
+outer:
+	for name, m := range metas.m {
+		for _, ex := range exclude {
+			if name == ex {
+				continue outer
+			}
+		}
+		if (!m.Leaving && !m.Joining) || ring.Contains(include, name) {
+			members = append(members, ring.Member{Name: name, Zone: m.Zone, Weight: m.Weight})
+		}
+	}
+	return ring.New(members)
+}
+
+// rebuildRing must be called with metas locked
+func (p *PeerList) rebuildRing() {
+	current = ringWithout()
+
+	p.metamutex.Lock()
+	p.local.Claim = current.Claim(p.Name)
+	p.metamutex.Unlock()
+
+	// don't block memberlist if nobody is listening
+	select {
+	case p.ringch <- struct{}{}:
+	default:
+	}
+}
+
+// Ring returns the ring as of the last membership change
+func (p PeerList) Ring() *ring.Ring {
+	metas.Lock()
+	defer metas.Unlock()
+	return current
+}
+
+// RingWithout returns the ring as it will be once the named nodes are gone
+func (p PeerList) RingWithout(names ...string) *ring.Ring {
+	metas.Lock()
+	defer metas.Unlock()
+	return ringWithout(names...)
+}
+
+// RingWith returns the ring as it will be once the named nodes have
+// finished joining and the others have left
+func (p PeerList) RingWith(joining, leaving []string) *ring.Ring {
+	metas.Lock()
+	defer metas.Unlock()
+	return ringOf(leaving, joining)
+}
+
+// Members lists every node we have metadata for, by name
+func (p PeerList) Members() map[string]Meta {
+	metas.Lock()
+	defer metas.Unlock()
+	acc := make(map[string]Meta, len(metas.m))
+	for name, m := range metas.m {
+		acc[name] = m
+	}
+	return acc
+}
+
+// RingChanges delivers a value whenever the ring is rebuilt (and our claim
+// may have changed), dropping them when the receiver is busy.
+func (p PeerList) RingChanges() <-chan struct{} {
+	return p.ringch
+}
+
+// Preferred lists the nodes that should hold key's n replicas, Alive ones
+// first and Suspect ones last, leaving out any that are Down.
+func (p PeerList) Preferred(key string, n int) []string {
+	pref := p.Ring().Preference(key, n)
+	alive, suspect := make([]string, 0, len(pref)), make([]string, 0)
+	for _, name := range pref {
+		switch p.State(name) {
+		case Alive:
+			alive = append(alive, name)
+		case Suspect:
+			suspect = append(suspect, name)
+		}
+	}
+	return append(alive, suspect...)
+}
+
+// VerifyAll sends msg to every recipient at once and counts the GOOD
+// replies that arrive within p.Timeout().
+func (p PeerList) VerifyAll(recipients []string, msg ...string) int {
+	responses := p.MultiMessageExpectResponse(recipients, p.Timeout(), msg...)
+	acc := 0
+	for _, str := range responses {
+		if len(str) > 0 && str[0] == "GOOD" {
+			acc += 1
+		}
+	}
+	return acc
+}
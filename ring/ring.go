@@ -0,0 +1,250 @@
+package ring
+
+import (
+	"hash/fnv"
+	"sort"
+)
+
+// A Ring divides the key space into a fixed number of partitions and gives
+// each one an owner. Every node builds the same Ring from the same members,
+// so nothing about it needs to be agreed on beyond membership.
+
+const Partitions = 64
+
+// { name, zone, relative capacity }
+type Member struct {
+	Name   string
+	Zone   string
+	Weight int
+}
+
+type Ring struct {
+	Owners  []string // partition -> member name
+	members map[string]Member
+	zones   int
+}
+
+// New claims partitions for members in proportion to their weights, trying
+// to give neighbouring partitions to members in different zones.
+func New(members []Member) *Ring {
+	r := &Ring{
+		Owners:  make([]string, 0, Partitions),
+		members: make(map[string]Member, len(members)),
+	}
+	if len(members) == 0 {
+		return r
+	}
+
+	sorted := make([]Member, len(members))
+	copy(sorted, members)
+	sort.Sort(byName(sorted))
+
+	zones := make(map[string]bool)
+	total := 0
+	for i := range sorted {
+		if sorted[i].Weight <= 0 {
+			sorted[i].Weight = 1
+		}
+		total += sorted[i].Weight
+		zones[sorted[i].Zone] = true
+		r.members[sorted[i].Name] = sorted[i]
+	}
+	r.zones = len(zones)
+
+	// how many partitions each member should end up with
+	quota := make([]float64, len(sorted))
+	for i, m := range sorted {
+		quota[i] = float64(Partitions*m.Weight) / float64(total)
+	}
+
+	for p := 0; p < Partitions; p++ {
+		best := -1
+		for i, m := range sorted {
+			if best == -1 || r.better(m, quota[i], sorted[best], quota[best], p) {
+				best = i
+			}
+		}
+		r.Owners = append(r.Owners, sorted[best].Name)
+		quota[best] -= 1
+	}
+
+	return r
+}
+
+// better decides whether a should own partition p rather than b: prefer a
+// member still short of their quota, then a zone unlike the previous
+// partition's, then a member not owning the last few, then whoever is
+// furthest short of their quota.
+func (r *Ring) better(a Member, qa float64, b Member, qb float64, p int) bool {
+	if oa, ob := qa > 0, qb > 0; oa != ob {
+		return oa
+	}
+	if p > 0 {
+		prev := r.members[r.Owners[p-1]].Zone
+		if za, zb := a.Zone != prev, b.Zone != prev; za != zb {
+			return za
+		}
+		ra, rb := r.recentlyOwns(a.Name, p), r.recentlyOwns(b.Name, p)
+		if ra != rb {
+			return !ra
+		}
+	}
+	return qa > qb
+}
+
+func (r *Ring) recentlyOwns(name string, p int) bool {
+	for i := p - 1; i >= 0 && i >= p-len(r.members)+1; i-- {
+		if r.Owners[i] == name {
+			return true
+		}
+	}
+	return false
+}
+
+// Partition finds which partition a key falls in
+func Partition(key string) int {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return int(h.Sum32() % Partitions)
+}
+
+// Preference lists up to n distinct members to hold a key's replicas.
+func (r *Ring) Preference(key string, n int) []string {
+	return r.PreferenceFor(Partition(key), n)
+}
+
+// PreferenceFor walks the ring from partition p, first picking owners from
+// zones not yet used and then, if there aren't enough zones, any owner not
+// yet picked.
+func (r *Ring) PreferenceFor(p, n int) []string {
+	if len(r.Owners) == 0 {
+		return nil
+	}
+	if n > len(r.members) {
+		n = len(r.members)
+	}
+	acc := make([]string, 0, n)
+	picked := make(map[string]bool, n)
+	zones := make(map[string]bool, n)
+
+	for i := 0; i < Partitions && len(acc) < n; i++ {
+		owner := r.Owners[(p+i)%Partitions]
+		zone := r.members[owner].Zone
+		if !picked[owner] && !zones[zone] {
+			acc = append(acc, owner)
+			picked[owner], zones[zone] = true, true
+		}
+	}
+	for i := 0; i < Partitions && len(acc) < n; i++ {
+		owner := r.Owners[(p+i)%Partitions]
+		if !picked[owner] {
+			acc = append(acc, owner)
+			picked[owner] = true
+		}
+	}
+	return acc
+}
+
+// Claim lists the partitions owned by name
+func (r *Ring) Claim(name string) []int {
+	acc := make([]int, 0)
+	for p, owner := range r.Owners {
+		if owner == name {
+			acc = append(acc, p)
+		}
+	}
+	return acc
+}
+
+// Members returns the members the ring was built from, by name
+func (r *Ring) Members() []Member {
+	acc := make([]Member, 0, len(r.members))
+	for _, m := range r.members {
+		acc = append(acc, m)
+	}
+	sort.Sort(byName(acc))
+	return acc
+}
+
+// A Violation is a partition whose replicas can't be spread over as many
+// zones (or nodes) as they should be.
+type Violation struct {
+	Partition int
+	Replicas  []string
+	Zones     int // zones the replicas are in
+	Want      int // zones they should be in
+}
+
+// Violations checks every partition's n replicas are in min(n, zones)
+// different zones, and that there are n of them at all.
+func (r *Ring) Violations(n int) []Violation {
+	want := n
+	if r.zones < want {
+		want = r.zones
+	}
+	acc := make([]Violation, 0)
+	for p := range r.Owners {
+		pref := r.PreferenceFor(p, n)
+		zones := make(map[string]bool, len(pref))
+		for _, name := range pref {
+			zones[r.members[name].Zone] = true
+		}
+		if len(zones) < want || len(pref) < n {
+			acc = append(acc, Violation{p, pref, len(zones), want})
+		}
+	}
+	return acc
+}
+
+// Zones counts the distinct zones among the members
+func (r *Ring) Zones() int {
+	return r.zones
+}
+
+type byName []Member
+
+func (b byName) Len() int           { return len(b) }
+func (b byName) Swap(i, j int)      { b[i], b[j] = b[j], b[i] }
+func (b byName) Less(i, j int) bool { return b[i].Name < b[j].Name }
+
+// A Transfer copies a partition's keys to a node that is to hold them
+type Transfer struct {
+	Partition int
+	From, To  string
+}
+
+// Transfers plans how to get from ring a to ring b with n replicas per
+// partition: each node that gains a partition is sent its keys by one of
+// the nodes that held it before, preferring one that is staying.
+func Transfers(a, b *Ring, n int) []Transfer {
+	acc := make([]Transfer, 0)
+	if len(a.Owners) == 0 {
+		return acc
+	}
+	for p := 0; p < Partitions; p++ {
+		before, after := a.PreferenceFor(p, n), b.PreferenceFor(p, n)
+		from := before[0]
+		for _, name := range before {
+			if _, staying := b.members[name]; staying {
+				from = name
+				break
+			}
+		}
+		for _, name := range after {
+			if !Contains(before, name) {
+				acc = append(acc, Transfer{p, from, name})
+			}
+		}
+	}
+	return acc
+}
+
+// Contains reports whether names has name
+func Contains(names []string, name string) bool {
+	for _, n := range names {
+		if n == name {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,86 @@
+package ring
+
+import "testing"
+
+func twoRacks() []Member {
+	return []Member{
+		{"a1", "rack-a", 1}, {"a2", "rack-a", 1}, {"a3", "rack-a", 1},
+		{"b1", "rack-b", 1}, {"b2", "rack-b", 1},
+	}
+}
+
+func TestZoneSpread(t *testing.T) {
+	r := New(twoRacks())
+	if v := r.Violations(3); len(v) != 0 {
+		t.Error("replicas not spread over both racks:", v)
+	}
+	for p := 0; p < Partitions; p++ {
+		pref := r.PreferenceFor(p, 3)
+		if len(pref) != 3 {
+			t.Fatal("short preference list", pref)
+		}
+		if pref[0] != r.Owners[p] {
+			t.Error("first replica isn't the partition owner", p, pref)
+		}
+	}
+}
+
+func TestOneZone(t *testing.T) {
+	r := New([]Member{{"a", "", 1}, {"b", "", 1}, {"c", "", 1}})
+	if v := r.Violations(3); len(v) != 0 {
+		t.Error("a single zone can't be violated:", v)
+	}
+	if v := r.Violations(4); len(v) != Partitions {
+		t.Error("four replicas on three nodes should violate every partition")
+	}
+}
+
+func TestWeights(t *testing.T) {
+	r := New([]Member{{"big", "x", 3}, {"small", "y", 1}})
+	if big := len(r.Claim("big")); big != 48 {
+		t.Error("big should claim 48 partitions, claimed", big)
+	}
+}
+
+func TestDeterministic(t *testing.T) {
+	ms := twoRacks()
+	a := New(ms)
+	ms[0], ms[4] = ms[4], ms[0]
+	b := New(ms)
+	for p := range a.Owners {
+		if a.Owners[p] != b.Owners[p] {
+			t.Fatal("member order changed the ring at partition", p)
+		}
+	}
+}
+
+func TestEmpty(t *testing.T) {
+	if pref := New(nil).Preference("key", 3); len(pref) != 0 {
+		t.Error("empty ring gave", pref)
+	}
+}
+
+func TestTransfers(t *testing.T) {
+	before := New([]Member{{"a", "", 1}, {"b", "", 1}, {"c", "", 1}})
+	if ts := Transfers(before, before, 3); len(ts) != 0 {
+		t.Error("no change should need no transfers:", ts)
+	}
+
+	after := New([]Member{{"a", "", 1}, {"b", "", 1}, {"c", "", 1}, {"d", "", 1}})
+	ts := Transfers(before, after, 3)
+	if len(ts) == 0 {
+		t.Fatal("joining d should move partitions to it")
+	}
+	for _, tr := range ts {
+		if tr.To != "d" || tr.From == "d" {
+			t.Error("bad transfer", tr)
+		}
+	}
+
+	gone := New([]Member{{"a", "", 1}, {"b", "", 1}, {"d", "", 1}})
+	for _, tr := range Transfers(after, gone, 3) {
+		if tr.From == "c" {
+			t.Error("leaving node chosen to send", tr)
+		}
+	}
+}
@@ -4,9 +4,11 @@ import (
 	"encoding/base64"
 	"errors"
 	"fmt"
+	"github.com/cormacrelf/mec-db/ring"
 	"github.com/cormacrelf/mec-db/vclock"
 	"github.com/ugorji/go/codec"
 	"reflect"
+	"strings"
 )
 
 // Takes <any command> message parts and returns key, value, content_type, VClock
@@ -61,14 +63,171 @@ func encodeDataMsg(cmd, key, value, content_type string, vc vclock.VClock) ([]st
 	return msg, nil
 }
 
-// Takes WRITE message parts and returns key, value, content_type, VClock
-func parseWriteMsg(naked bool, msg ...string) (string, string, string, vclock.VClock, error) {
-	return parseDataMsg(naked, msg...)
+// Frames each message type needs, counting ROUTER's routing frame. Any
+// after these are options, like a trace's "tp=" frame.
+const (
+	writeFrames   = 6
+	getFrames     = 3
+	handoffFrames = 4
+)
+
+// optionFrames returns the frames after the fixed ones
+func optionFrames(msg []string, fixed int) []string {
+	if len(msg) <= fixed {
+		return nil
+	}
+	return msg[fixed:]
+}
+
+// Frames in a DATA reply; a sibling of the value follows in each "sib="
+// frame after them.
+const dataFrames = 5
+
+// An option frame asking a replica to reply to a WRITE with what it holds
+// afterwards: GOOD, then the frames of a DATA reply.
+const returnBodyFrame = "rb=1"
+
+func hasOption(frames []string, option string) bool {
+	for _, f := range frames {
+		if f == option {
+			return true
+		}
+	}
+	return false
+}
+
+// An option frame carrying the Dot of a WRITE's value, or of the first
+// value in a DATA reply
+const dotPrefix = "dot="
+
+// withDot adds d's frame to msg, if there's a dot at all
+func withDot(msg []string, d Dot) ([]string, error) {
+	if d.Actor == "" {
+		return msg, nil
+	}
+	var mh codec.MsgpackHandle
+	var b []byte
+
+	enc := codec.NewEncoderBytes(&b, &mh)
+	err := enc.Encode(d)
+	if err != nil {
+		return nil, errors.New("failed to encode dot")
+	}
+	return append(msg, dotPrefix+string(b)), nil
+}
+
+// parseDot finds the Dot among option frames; without one it's zero
+func parseDot(frames []string) (Dot, error) {
+	var mh codec.MsgpackHandle
+	var d Dot
+	for _, f := range frames {
+		if !strings.HasPrefix(f, dotPrefix) {
+			continue
+		}
+		dec := codec.NewDecoderBytes([]byte(strings.TrimPrefix(f, dotPrefix)), &mh)
+		if err := dec.Decode(&d); err != nil {
+			return Dot{}, errors.New("dot not decoded")
+		}
+	}
+	return d, nil
+}
+
+// Encode a DATA reply holding every version in st, or another reply with
+// the same frames
+func encodeDataReply(cmd, key string, st Storable) ([]string, error) {
+	msg, err := encodeDataMsg(cmd, key, st.Value, st.Content_Type, st.VC)
+	if err != nil {
+		return nil, err
+	}
+	if msg, err = withDot(msg, st.Dot); err != nil {
+		return nil, err
+	}
+	for _, v := range st.Siblings {
+		b, err := encodeVersion(v)
+		if err != nil {
+			return nil, err
+		}
+		msg = append(msg, "sib="+string(b))
+	}
+	return msg, nil
+}
+
+// Takes a DATA reply, or a GOOD reply with a body, and returns every
+// version in it
+func parseDataReply(msg ...string) ([]Version, error) {
+	if len(msg) == 0 || (msg[0] != "DATA" && msg[0] != "GOOD") {
+		return nil, errors.New("not a DATA reply")
+	}
+	_, value, content_type, vc, err := parseDataMsg(true, msg...)
+	if err != nil {
+		return nil, err
+	}
+	dot, err := parseDot(optionFrames(msg, dataFrames))
+	if err != nil {
+		return nil, err
+	}
+	vs := []Version{{value, content_type, vc, dot}}
+	for _, f := range optionFrames(msg, dataFrames) {
+		if !strings.HasPrefix(f, "sib=") {
+			continue
+		}
+		v, err := decodeVersion([]byte(strings.TrimPrefix(f, "sib=")))
+		if err != nil {
+			return nil, err
+		}
+		vs = append(vs, v)
+	}
+	return vs, nil
+}
+
+func encodeVersion(v Version) ([]byte, error) {
+	var mh codec.MsgpackHandle
+	var b []byte
+
+	enc := codec.NewEncoderBytes(&b, &mh)
+	err := enc.Encode(v)
+	if err != nil {
+		return nil, errors.New("failed to encode sibling")
+	}
+	return b, nil
+}
+
+func decodeVersion(data []byte) (Version, error) {
+	var mh codec.MsgpackHandle
+	var v Version
+
+	dec := codec.NewDecoderBytes(data, &mh)
+	err := dec.Decode(&v)
+	if err != nil {
+		return Version{}, errors.New("sibling not decoded")
+	}
+	return v, nil
+}
+
+// Takes WRITE message parts and returns key and the Version written
+func parseWriteMsg(naked bool, msg ...string) (string, Version, error) {
+	key, value, content_type, vc, err := parseDataMsg(naked, msg...)
+	if err != nil {
+		return key, Version{}, err
+	}
+	fixed := writeFrames
+	if naked {
+		fixed -= 1
+	}
+	dot, err := parseDot(optionFrames(msg, fixed))
+	if err != nil {
+		return key, Version{}, err
+	}
+	return key, Version{value, content_type, vc, dot}, nil
 }
 
 // Encode WRITE message parts into sendable zeromq message
-func encodeWriteMsg(key, value, content_type string, vc vclock.VClock) ([]string, error) {
-	return encodeDataMsg("WRITE", key, value, content_type, vc)
+func encodeWriteMsg(key string, v Version) ([]string, error) {
+	msg, err := encodeDataMsg("WRITE", key, v.Value, v.Content_Type, v.VC)
+	if err != nil {
+		return nil, err
+	}
+	return withDot(msg, v.Dot)
 }
 
 // Takes message parts and returns key
@@ -92,6 +251,69 @@ func encodeGetMsg(key string) []string {
 	return msg
 }
 
+// Takes HANDOFF message parts and returns key, Storable
+func parseHandoffMsg(naked bool, msg ...string) (string, Storable, error) {
+	var ia int
+	if naked {
+		ia = 0
+	} else {
+		ia = 1 // get past ROUTER's routing data
+	}
+
+	if len(msg) < ia+3 {
+		return "", Storable{}, errors.New("failed to parse message")
+	}
+
+	// "HANDOFF" "key:string" "storable:[]byte"
+	st, err := decodeStorable([]byte(msg[ia+2]))
+	return msg[ia+1], st, err
+}
+
+// Encode HANDOFF message parts; obj is an encoded Storable, straight
+// from the database
+func encodeHandoffMsg(key string, obj []byte) []string {
+	msg := make([]string, 3)
+	msg[0], msg[1], msg[2] = "HANDOFF", key, string(obj)
+
+	return msg
+}
+
+// Encode a TRANSFER message: a list of partitions to send to other nodes
+func EncodeTransferMsg(ts []ring.Transfer) ([]string, error) {
+	var mh codec.MsgpackHandle
+	var b []byte
+
+	enc := codec.NewEncoderBytes(&b, &mh)
+	err := enc.Encode(ts)
+	if err != nil {
+		return nil, errors.New("failed to encode transfers")
+	}
+	return []string{"TRANSFER", string(b)}, nil
+}
+
+// Takes TRANSFER message parts and returns the transfers
+func parseTransferMsg(naked bool, msg ...string) ([]ring.Transfer, error) {
+	var mh codec.MsgpackHandle
+	var ts []ring.Transfer
+
+	var ia int
+	if naked {
+		ia = 0
+	} else {
+		ia = 1 // get past ROUTER's routing data
+	}
+	if len(msg) < ia+2 {
+		return nil, errors.New("failed to parse message")
+	}
+
+	dec := codec.NewDecoderBytes([]byte(msg[ia+1]), &mh)
+	err := dec.Decode(&ts)
+	if err != nil {
+		return nil, errors.New("transfers not decoded")
+	}
+	return ts, nil
+}
+
 func parseVClock(encoded string) (vclock.VClock, error) {
 	data, err := base64.StdEncoding.DecodeString(encoded)
 	if err != nil {
@@ -127,10 +349,14 @@ func encodeVClock(vc vclock.VClock) (string, error) {
 	return str, nil
 }
 
+// What's kept for each key: the newest value, and any others written
+// concurrently with it
 type Storable struct {
 	Value        string
 	Content_Type string
 	VC           vclock.VClock
+	Dot          Dot
+	Siblings     []Version
 }
 
 func encodeStorable(wr Storable) ([]byte, error) {
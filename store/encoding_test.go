@@ -0,0 +1,88 @@
+package store
+
+import (
+	"github.com/cormacrelf/mec-db/vclock"
+	"reflect"
+	"testing"
+)
+
+var (
+	mine   = Version{"mine", "text/plain", vclock.VClock{"client": {Counter: 1, Timestamp: 10}}, Dot{"node-a", 5, 20}}
+	theirs = Version{"theirs", "text/plain", vclock.VClock{"client": {Counter: 1, Timestamp: 10}}, Dot{"node-b", 3, 30}}
+)
+
+func TestGoodReplyRoundTrip(t *testing.T) {
+	msg, err := encodeDataReply("GOOD", "key", storableOf([]Version{mine, theirs}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg[0] != "GOOD" {
+		t.Fatalf("reply starts %q", msg[0])
+	}
+	vs, err := parseDataReply(msg...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(vs, []Version{mine, theirs}) {
+		t.Errorf("got %+v", vs)
+	}
+
+	if _, err := parseDataReply("GOOD"); err == nil {
+		t.Error("a GOOD from an old replica parsed as a body")
+	}
+}
+
+func TestReturnBodyFrame(t *testing.T) {
+	msg, err := encodeWriteMsg("key", mine)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// as the replica gets it, after the sender's identity
+	plain := append([]string{"id"}, msg...)
+	rb := append(append([]string{"id"}, msg...), returnBodyFrame)
+
+	if hasOption(optionFrames(plain, writeFrames), returnBodyFrame) {
+		t.Error("a write without rb=1 asked for the body")
+	}
+	if !hasOption(optionFrames(rb, writeFrames), returnBodyFrame) {
+		t.Error("a write with rb=1 didn't ask for the body")
+	}
+	// the extra frame mustn't get in the way of the write itself
+	if key, v, err := parseWriteMsg(false, rb...); err != nil || key != "key" || !reflect.DeepEqual(v, mine) {
+		t.Errorf("got %s %+v %v", key, v, err)
+	}
+}
+
+func TestWriteReplies(t *testing.T) {
+	good, err := encodeDataReply("GOOD", "key", storableOf([]Version{mine, theirs}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	nodes := []string{"a", "b"}
+
+	// new replicas send what they hold
+	written, aerr := writeQuorum(nil, nodes, map[string][]string{"a": good, "b": {"GOOD"}}, 2)
+	if aerr != nil {
+		t.Fatal(aerr)
+	}
+	maybe, _ := writeResult(mine, written, true)
+	if !maybe.Multi || len(maybe.Multiple) != 2 {
+		t.Errorf("wanted both siblings, got %+v", maybe)
+	}
+
+	// old ones only say GOOD, which still counts
+	written, aerr = writeQuorum(nil, nodes, map[string][]string{"a": {"GOOD"}, "b": {"GOOD"}}, 2)
+	if aerr != nil || len(written) != 0 {
+		t.Fatalf("got %v, %v", written, aerr)
+	}
+	maybe, vc := writeResult(mine, written, true)
+	if maybe.Multi || maybe.Single.Value != "mine" || vc["node-a"].Counter != 5 {
+		t.Errorf("wanted what was written, got %+v %v", maybe, vc)
+	}
+
+	// and without returnbody there's nothing to say but the clock
+	maybe, vc = writeResult(mine, nil, false)
+	if maybe.Multi || maybe.Single.Value != "" || !vclock.Equal(vc, mine.clock()) {
+		t.Errorf("got %+v %v", maybe, vc)
+	}
+}
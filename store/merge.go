@@ -0,0 +1,266 @@
+package store
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"github.com/cormacrelf/mec-db/vclock"
+	"github.com/jmhodges/levigo"
+	"hash/fnv"
+	"io"
+	"sort"
+	"sync"
+)
+
+// A Version is one value of a key and the clock it was written with. A
+// write a node coordinated also has a Dot, and then VC is only what its
+// client had seen.
+type Version struct {
+	Value        string
+	Content_Type string
+	VC           vclock.VClock
+	Dot          Dot
+}
+
+// A Dot names one write: the node that coordinated it and the counter it
+// took. A zero Dot means the write's clock was incremented by its client.
+type Dot struct {
+	Actor     string
+	Counter   int
+	Timestamp int64
+}
+
+func (d Dot) same(other Dot) bool {
+	return d.Actor == other.Actor && d.Counter == other.Counter
+}
+
+// clock is everything v's writer had seen, and v itself
+func (v Version) clock() vclock.VClock {
+	if v.Dot.Actor == "" {
+		return v.VC
+	}
+	vc := vclock.Merge([]vclock.VClock{v.VC})
+	if vc[v.Dot.Actor].Counter < v.Dot.Counter {
+		vc[v.Dot.Actor] = vclock.Entry{Counter: v.Dot.Counter, Timestamp: v.Dot.Timestamp}
+	}
+	return vc
+}
+
+// seen reports whether b's writer had seen a, so a can go
+func seen(b, a Version) bool {
+	if a.Dot.Actor != "" {
+		return !a.Dot.same(b.Dot) && b.VC[a.Dot.Actor].Counter >= a.Dot.Counter
+	}
+	return vclock.Compare(b.clock(), a.VC) == 1
+}
+
+// sameWrite reports whether a and b came from the same write, or from
+// writes that can't be told apart
+func sameWrite(a, b Version) bool {
+	if a.Dot.Actor != "" || b.Dot.Actor != "" {
+		return a.Dot.same(b.Dot)
+	}
+	return vclock.Equal(a.VC, b.VC)
+}
+
+// vtag is a short hash of v's value and clock, the same on every node
+func (v Version) vtag() string {
+	h := sha1.New()
+	io.WriteString(h, v.Value)
+	h.Write([]byte{0})
+	// only counters, sorted by actor
+	io.WriteString(h, v.clock().String())
+	return hex.EncodeToString(h.Sum(nil)[:8])
+}
+
+// versions lists every value in st, its own first
+func (st Storable) versions() []Version {
+	vs := make([]Version, 0, 1+len(st.Siblings))
+	vs = append(vs, Version{st.Value, st.Content_Type, st.VC, st.Dot})
+	return append(vs, st.Siblings...)
+}
+
+// storableOf keeps vs, the first as the Storable's own value
+func storableOf(vs []Version) Storable {
+	st := Storable{vs[0].Value, vs[0].Content_Type, vs[0].VC, vs[0].Dot, nil}
+	if len(vs) > 1 {
+		st.Siblings = vs[1:]
+	}
+	return st
+}
+
+// reconcile drops every version another's writer had seen, keeping the
+// newer of any two from the same write, and returns what's left newest
+// first. More than one left are siblings: concurrent writes nobody has
+// resolved.
+func reconcile(vs []Version) []Version {
+	latest := make([]Version, 0, len(vs))
+	for i, v := range vs {
+		keep := true
+		for j, other := range vs {
+			if i == j {
+				continue
+			}
+			if seen(other, v) {
+				keep = false
+				break
+			}
+			if sameWrite(other, v) && later(other, v, j, i) {
+				keep = false
+				break
+			}
+		}
+		if keep {
+			latest = append(latest, v)
+		}
+	}
+	sort.Stable(newestFirst(latest))
+	return latest
+}
+
+// later breaks ties between versions of the same write: the newest wins,
+// then whichever came later in the list.
+func later(a, b Version, i, j int) bool {
+	ta, tb := a.clock().MaxTimestamp(), b.clock().MaxTimestamp()
+	if ta != tb {
+		return ta > tb
+	}
+	return i > j
+}
+
+type newestFirst []Version
+
+func (n newestFirst) Len() int      { return len(n) }
+func (n newestFirst) Swap(i, j int) { n[i], n[j] = n[j], n[i] }
+func (n newestFirst) Less(i, j int) bool {
+	return n[i].clock().MaxTimestamp() > n[j].clock().MaxTimestamp()
+}
+
+// holds reports whether vs has v: the same write and the same value
+func holds(vs []Version, v Version) bool {
+	for _, h := range vs {
+		if sameWrite(h, v) && h.Value == v.Value && h.Content_Type == v.Content_Type {
+			return true
+		}
+	}
+	return false
+}
+
+// sameVersions reports whether a and b hold the same versions
+func sameVersions(a, b []Version) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for _, v := range a {
+		if !holds(b, v) {
+			return false
+		}
+	}
+	return true
+}
+
+// Striped locks, so two writes to one key can't interleave their read and
+// write. Keys share a lock now and then, which only costs a little waiting.
+const lockStripes = 256
+
+type keyLocks [lockStripes]sync.Mutex
+
+func (l *keyLocks) of(key string) *sync.Mutex {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return &l[h.Sum32()%lockStripes]
+}
+
+// keyMutexes are a lock for each key, kept only while someone holds or
+// waits for it, for work too slow to share a stripe with other keys.
+type keyMutexes struct {
+	mu sync.Mutex
+	m  map[string]*keyMutex
+}
+
+type keyMutex struct {
+	sync.Mutex
+	refs int
+}
+
+func newKeyMutexes() *keyMutexes {
+	return &keyMutexes{m: make(map[string]*keyMutex)}
+}
+
+// lock locks key and returns the function that unlocks it
+func (k *keyMutexes) lock(key string) func() {
+	k.mu.Lock()
+	m := k.m[key]
+	if m == nil {
+		m = new(keyMutex)
+		k.m[key] = m
+	}
+	m.refs += 1
+	k.mu.Unlock()
+
+	m.Lock()
+	return func() {
+		m.Unlock()
+		k.mu.Lock()
+		m.refs -= 1
+		if m.refs == 0 {
+			delete(k.m, key)
+		}
+		k.mu.Unlock()
+	}
+}
+
+// DBMerge folds st into what's stored for key and returns the result. It
+// only ever moves a key forwards: anything st's clocks are behind is
+// ignored, and anything concurrent is kept as a sibling.
+func (s Store) DBMerge(key string, st Storable) (Storable, error) {
+	mu := s.locks.of(key)
+	mu.Lock()
+	defer mu.Unlock()
+
+	local, found, err := s.load(key)
+	if err != nil {
+		log.Error("merge failed", "key", key, "err", err)
+		return Storable{}, err
+	}
+	incoming := st.versions()
+	all := incoming
+	if found {
+		all = append(local.versions(), incoming...)
+	}
+	merged := reconcile(all)
+	if found && sameVersions(merged, local.versions()) {
+		// nothing new; usually a repair we've already had
+		return local, nil
+	}
+
+	// never the value: it's the client's business
+	log.Debug("write", "key", key, "content_type", st.Content_Type,
+		"bytes", len(st.Value), "siblings", len(merged)-1)
+	result := storableOf(merged)
+	obj, err := encodeStorable(result)
+	if err != nil {
+		log.Error("write failed", "key", key, "err", err)
+		return Storable{}, err
+	}
+	wb := levigo.NewWriteBatch()
+	defer wb.Close()
+	wb.Put([]byte(key), obj)
+	if err = s.db.Write(s.wo, wb); err != nil {
+		log.Error("write failed", "key", key, "err", err)
+		return Storable{}, err
+	}
+	return result, nil
+}
+
+// load reads key's Storable, if there is one
+func (s Store) load(key string) (Storable, bool, error) {
+	obj, err := s.db.Get(s.ro, []byte(key))
+	if err != nil || obj == nil {
+		return Storable{}, false, err
+	}
+	st, err := decodeStorable(obj)
+	if err != nil {
+		return Storable{}, false, err
+	}
+	return st, true, nil
+}
@@ -0,0 +1,94 @@
+package store
+
+import (
+	"github.com/cormacrelf/mec-db/vclock"
+	"testing"
+)
+
+func TestReconcileDropsAncestors(t *testing.T) {
+	old := Version{"1", "text/plain", vclock.VClock{"lion": {Counter: 1, Timestamp: 100}}, Dot{}}
+	new := Version{"2", "text/plain", vclock.VClock{"lion": {Counter: 2, Timestamp: 200}}, Dot{}}
+
+	for _, vs := range [][]Version{{old, new}, {new, old}} {
+		latest := reconcile(vs)
+		if len(latest) != 1 || latest[0].Value != "2" {
+			t.Errorf("reconcile(%v) = %v, want only the newer", vs, latest)
+		}
+	}
+}
+
+func TestReconcileKeepsSiblings(t *testing.T) {
+	a := Version{"a", "text/plain", vclock.VClock{"lion": {Counter: 2, Timestamp: 100}, "gazelle": {Counter: 1, Timestamp: 50}}, Dot{}}
+	b := Version{"b", "text/plain", vclock.VClock{"lion": {Counter: 1, Timestamp: 50}, "gazelle": {Counter: 2, Timestamp: 200}}, Dot{}}
+	repair := Version{"old", "text/plain", vclock.VClock{"lion": {Counter: 1, Timestamp: 50}, "gazelle": {Counter: 1, Timestamp: 50}}, Dot{}}
+
+	latest := reconcile([]Version{a, repair, b})
+	if len(latest) != 2 {
+		t.Fatalf("got %d versions, want 2 siblings", len(latest))
+	}
+	if latest[0].Value != "b" || latest[1].Value != "a" {
+		t.Errorf("siblings not newest first: %v", latest)
+	}
+	if !sameVersions(latest, []Version{b, a}) {
+		t.Error("sameVersions should ignore order")
+	}
+}
+
+func TestReconcileEqualClocks(t *testing.T) {
+	first := Version{"first", "text/plain", vclock.VClock{"lion": {Counter: 1, Timestamp: 100}}, Dot{}}
+	second := Version{"second", "text/plain", vclock.VClock{"lion": {Counter: 1, Timestamp: 200}}, Dot{}}
+
+	latest := reconcile([]Version{second, first})
+	if len(latest) != 1 || latest[0].Value != "second" {
+		t.Errorf("equal clocks should keep the newest, got %v", latest)
+	}
+}
+
+func TestVtagStable(t *testing.T) {
+	// the same write as two nodes might hold it: timestamps differ, and
+	// the clocks' entries went in in different orders
+	here, there := vclock.VClock{}, vclock.VClock{}
+	actors := []string{"a", "b", "c", "d", "e", "f", "g", "h"}
+	for i, a := range actors {
+		here[a] = vclock.Entry{Counter: i + 1, Timestamp: 100}
+		b := actors[len(actors)-1-i]
+		there[b] = vclock.Entry{Counter: len(actors) - i, Timestamp: 200 + int64(i)}
+	}
+	v := Version{"value", "text/plain", here, Dot{"node", 9, 100}}
+	w := Version{"value", "text/plain", there, Dot{"node", 9, 300}}
+	if v.vtag() != w.vtag() {
+		t.Errorf("the same version has vtags %s and %s", v.vtag(), w.vtag())
+	}
+
+	other := Version{"other value", "text/plain", here, Dot{"node", 9, 100}}
+	later := Version{"value", "text/plain", here, Dot{"node", 10, 100}}
+	if other.vtag() == v.vtag() || later.vtag() == v.vtag() {
+		t.Error("different versions share a vtag")
+	}
+}
+
+func TestFindSibling(t *testing.T) {
+	vc := vclock.VClock{"a": {Counter: 1, Timestamp: 10}}
+	vs := []Version{
+		{"one", "text/plain", vc, Dot{"node-a", 2, 20}},
+		{"two", "text/plain", vc, Dot{"node-b", 2, 30}},
+	}
+	maybe, _ := maybeOf(vs)
+	if !maybe.Multi {
+		t.Fatalf("wanted siblings, got %+v", maybe)
+	}
+	for _, v := range vs {
+		rv, ok := maybe.Find(v.vtag())
+		if !ok || rv.Value != v.Value {
+			t.Errorf("looking for %s found %+v, %v", v.Value, rv, ok)
+		}
+	}
+	if rv, ok := maybe.Find("0123456789abcdef"); ok {
+		t.Errorf("found %+v for an unknown vtag", rv)
+	}
+
+	single, _ := maybeOf(vs[:1])
+	if _, ok := single.Find(vs[1].vtag()); ok {
+		t.Error("found another version's vtag in a single value")
+	}
+}
@@ -0,0 +1,62 @@
+package store
+
+import (
+	"hash/fnv"
+	"sync"
+)
+
+// A job is a message and what to do with it
+type job struct {
+	msg    []string
+	handle func([]string)
+}
+
+// shards run jobs on a fixed set of goroutines, always giving jobs for the
+// same key to the same one. Jobs for a key happen one at a time, in the
+// order they were dispatched; jobs for different keys happen in parallel.
+type shards struct {
+	chans []chan job
+}
+
+func newShards(n, depth int) *shards {
+	s := &shards{make([]chan job, n)}
+	for i := range s.chans {
+		s.chans[i] = make(chan job, depth)
+	}
+	return s
+}
+
+func (s *shards) of(key string) chan job {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return s.chans[h.Sum32()%uint32(len(s.chans))]
+}
+
+// dispatch queues a job for key's shard, or returns false if the shard is
+// full. It never waits, so one busy key can't hold up the others.
+func (s *shards) dispatch(key string, j job) bool {
+	select {
+	case s.of(key) <- j:
+		return true
+	default:
+		return false
+	}
+}
+
+// run starts a goroutine for each shard, which stop when quit closes
+func (s *shards) run(quit <-chan struct{}, wg *sync.WaitGroup) {
+	for _, c := range s.chans {
+		wg.Add(1)
+		go func(c chan job) {
+			defer wg.Done()
+			for {
+				select {
+				case <-quit:
+					return
+				case j := <-c:
+					j.handle(j.msg)
+				}
+			}
+		}(c)
+	}
+}
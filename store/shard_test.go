@@ -0,0 +1,140 @@
+package store
+
+import (
+	"github.com/cormacrelf/mec-db/vclock"
+	"runtime"
+	"strconv"
+	"sync"
+	"testing"
+)
+
+// dispatchWait retries until key's shard has room, as a sender told BUSY
+// would
+func dispatchWait(sh *shards, key string, j job) {
+	for !sh.dispatch(key, j) {
+		runtime.Gosched()
+	}
+}
+
+func TestShardsKeepOrder(t *testing.T) {
+	quit := make(chan struct{})
+	var wg sync.WaitGroup
+	sh := newShards(4, 2)
+	sh.run(quit, &wg)
+
+	var mu sync.Mutex
+	seen := make(map[string][]int)
+	var done sync.WaitGroup
+	handle := func(msg []string) {
+		i, _ := strconv.Atoi(msg[1])
+		mu.Lock()
+		seen[msg[0]] = append(seen[msg[0]], i)
+		mu.Unlock()
+		done.Done()
+	}
+	keys := []string{"lion", "gazelle", "zebra", "hyena", "vulture"}
+	for i := 0; i < 100; i++ {
+		for _, k := range keys {
+			done.Add(1)
+			dispatchWait(sh, k, job{[]string{k, strconv.Itoa(i)}, handle})
+		}
+	}
+	done.Wait()
+	close(quit)
+	wg.Wait()
+
+	for _, k := range keys {
+		if len(seen[k]) != 100 {
+			t.Fatalf("%s: handled %d of 100", k, len(seen[k]))
+		}
+		for i, n := range seen[k] {
+			if n != i {
+				t.Fatalf("%s: handled %d at %d", k, n, i)
+			}
+		}
+	}
+}
+
+func TestShardsFull(t *testing.T) {
+	quit := make(chan struct{})
+	var wg sync.WaitGroup
+	sh := newShards(2, 1)
+	sh.run(quit, &wg)
+
+	// hold up the lion's shard, and fill its queue
+	hold, started := make(chan struct{}), make(chan struct{})
+	block := func([]string) {
+		started <- struct{}{}
+		<-hold
+	}
+	sh.dispatch("lion", job{nil, block})
+	<-started
+	if !sh.dispatch("lion", job{nil, func([]string) {}}) {
+		t.Fatal("an empty queue turned a job away")
+	}
+	if sh.dispatch("lion", job{nil, func([]string) {}}) {
+		t.Error("a full shard took another job")
+	}
+
+	// another shard's keys carry on
+	other := "gazelle"
+	for i := 0; sh.of(other) == sh.of("lion"); i++ {
+		other = "gazelle" + strconv.Itoa(i)
+	}
+	ran := make(chan struct{})
+	if !sh.dispatch(other, job{nil, func([]string) { close(ran) }}) {
+		t.Fatal("a full shard turned away another shard's job")
+	}
+	<-ran
+
+	close(hold)
+	close(quit)
+	wg.Wait()
+}
+
+// BenchmarkShards merges 4KB writes to many keys into a temporary database
+// through the shards, as replicas do. Each write follows on from the last
+// one to its key, so it replaces it rather than piling up siblings.
+// Compare cores with go test -bench Shards -cpu 1,2,4,8
+func BenchmarkShards(b *testing.B) {
+	s := tempStore(b, "lion")
+	quit := make(chan struct{})
+	var wg sync.WaitGroup
+	sh := newShards(DefaultLimits.Workers, shardDepth)
+	sh.run(quit, &wg)
+
+	keys := make([]string, 1024)
+	for i := range keys {
+		keys[i] = "key" + strconv.Itoa(i)
+	}
+	// only ever touched by the key's own shard
+	clocks := make([]vclock.VClock, len(keys))
+
+	value := string(make([]byte, 4096))
+	var done sync.WaitGroup
+	handle := func(msg []string) {
+		defer done.Done()
+		i, _ := strconv.Atoi(msg[1])
+		v := Version{value, "application/octet-stream", clocks[i], s.nextDot(clocks[i])}
+		st, err := s.DBMerge(msg[0], storableOf([]Version{v}))
+		if err != nil {
+			b.Error(err)
+		}
+		if len(st.Siblings) > 0 {
+			b.Errorf("%s has %d siblings", msg[0], len(st.Siblings))
+		}
+		clocks[i] = st.versions()[0].clock()
+	}
+
+	b.SetBytes(int64(len(value)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		n := i % len(keys)
+		done.Add(1)
+		dispatchWait(sh, keys[n], job{[]string{keys[n], strconv.Itoa(n)}, handle})
+	}
+	done.Wait()
+	b.StopTimer()
+	close(quit)
+	wg.Wait()
+}
@@ -1,11 +1,18 @@
 package store
 
 import (
-	"fmt"
+	"errors"
 	api "github.com/cormacrelf/mec-db/api/apierrors"
+	"github.com/cormacrelf/mec-db/logging"
+	"github.com/cormacrelf/mec-db/metrics"
 	"github.com/cormacrelf/mec-db/peers"
+	"github.com/cormacrelf/mec-db/ring"
+	"github.com/cormacrelf/mec-db/trace"
 	"github.com/cormacrelf/mec-db/vclock"
 	"github.com/jmhodges/levigo"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
 // handles
@@ -18,131 +25,666 @@ import (
 // - VClocks at every stage
 
 const (
-	N = 3
-	R = 3
-	W = 1
+	// times to offer each key to its new owners when leaving
+	handoffAttempts = 3
+)
+
+// { replicas per key, replicas that must answer a read, replicas that must
+// acknowledge a write }
+type Quorum struct {
+	N, R, W int
+}
+
+var DefaultQuorum = Quorum{N: 3, R: 3, W: 1}
+
+// How clients' clocks are checked. Strict turns away clocks that don't
+// decode or aren't valid; otherwise they're quietly replaced with a fresh
+// one, which makes siblings. Clocks bigger than the limits are turned away
+// either way.
+type ClockPolicy struct {
+	Strict     bool
+	MaxBytes   int // base64, as in X-Mec-Vclock
+	MaxEntries int
+}
+
+var DefaultClockPolicy = ClockPolicy{Strict: true, MaxBytes: 4096, MaxEntries: 64}
+
+// { goroutines handling messages from other nodes, and how many of each
+// type may queue before their senders are told BUSY }
+type Limits struct {
+	Workers, Queue int
+}
+
+var DefaultLimits = Limits{Workers: 16, Queue: 256}
+
+// Whose entry in a key's clock a write increments
+type Actors int
+
+const (
+	// the coordinating node's, as a dot on top of the client's clock.
+	// Clients only have to send back the clocks they get.
+	NodeActors Actors = iota
+	// whatever the client names in X-Mec-Client-ID. Clients must each have
+	// a stable ID of their own or their writes will clobber each other.
+	ClientActors
+)
+
+var log = logging.With("component", "store")
+
+var (
+	quorums = metrics.NewCounterVec("mec_quorum_total",
+		"Coordinated reads and writes by outcome.", "op", "outcome")
+	quorumDuration = metrics.NewHistogramVec("mec_quorum_duration_seconds",
+		"Time to reach a quorum, or give up.", metrics.DefBuckets, "op")
+	siblingReads = metrics.NewCounter("mec_sibling_reads_total",
+		"Reads that found siblings.")
+	readRepairs = metrics.NewCounter("mec_read_repairs_total",
+		"Replicas sent a newer value after a read found them out of date.")
+	siblings = metrics.NewHistogram("mec_read_siblings",
+		"Values returned by each successful read; more than one are siblings.", []float64{1, 2, 3, 5, 10})
 )
 
 type Store struct {
-	ro *levigo.ReadOptions
-	wo *levigo.WriteOptions
-	db *levigo.DB
-	pl *peers.PeerList
+	ro      *levigo.ReadOptions
+	wo      *levigo.WriteOptions
+	db      *levigo.DB
+	pl      *peers.PeerList
+	leaving *int32 // set once we stop taking writes
+	quit    chan struct{}
+	done    chan struct{}
+	work    *sync.WaitGroup // transfers running in the background
+	quorum  *atomic.Value
+	limits  Limits
+	locks   *keyLocks   // replica writes, see DBMerge
+	writing *keyMutexes // coordinated writes, see APIWrite
+	dots    *int64      // the last dot counter this node took, see nextDot
+	actors  *atomic.Value
+	clocks  *atomic.Value
+	reqlog  *logging.Logger // see WithLog
+}
+
+func Create(db *levigo.DB, pl *peers.PeerList, q Quorum, l Limits) *Store {
+	s := newStore(db, pl, q, l)
+	go s.Listen()
+	return s
 }
 
-func Create(db *levigo.DB, pl *peers.PeerList) *Store {
+func newStore(db *levigo.DB, pl *peers.PeerList, q Quorum, l Limits) *Store {
 	s := Store{
-		ro: levigo.NewReadOptions(),
-		wo: levigo.NewWriteOptions(),
-		db: db,
-		pl: pl,
+		ro:      levigo.NewReadOptions(),
+		wo:      levigo.NewWriteOptions(),
+		db:      db,
+		pl:      pl,
+		leaving: new(int32),
+		quit:    make(chan struct{}),
+		done:    make(chan struct{}),
+		work:    &sync.WaitGroup{},
+		quorum:  &atomic.Value{},
+		limits:  l,
+		locks:   &keyLocks{},
+		writing: newKeyMutexes(),
+		// carry on from the time we started, so counters keep going up
+		// across restarts without being stored anywhere
+		dots:   new(int64),
+		actors: &atomic.Value{},
+		clocks: &atomic.Value{},
 	}
+	*s.dots = time.Now().UnixNano() / int64(time.Microsecond)
+	s.quorum.Store(q)
+	s.actors.Store(NodeActors)
+	s.clocks.Store(DefaultClockPolicy)
+	return &s
+}
 
-	go s.Listen()
-
+// WithLog returns a Store that logs reads and writes, and its peers'
+// trouble with them, with l's fields, eg the request they're for
+func (s Store) WithLog(l *logging.Logger) *Store {
+	s.reqlog = l
 	return &s
 }
 
+// keyLog has the fields for anything logged about key, for the peers asked
+// about it too
+func (s Store) keyLog(key string) *logging.Logger {
+	if s.reqlog == nil {
+		return logging.With("key", key)
+	}
+	return s.reqlog.With("key", key)
+}
+
+// logger is where the store logs about key
+func (s Store) logger(key string) *logging.Logger {
+	return s.keyLog(key).With("component", "store")
+}
+
+func (s Store) Quorum() Quorum {
+	return s.quorum.Load().(Quorum)
+}
+
+// SetQuorum changes R and W on the fly. N can't change without moving data
+// around, so it has to stay the same.
+func (s Store) SetQuorum(q Quorum) error {
+	if q.N != s.Quorum().N {
+		return errors.New("n can't change while running")
+	}
+	s.quorum.Store(q)
+	return nil
+}
+
+func (s Store) Actors() Actors {
+	return s.actors.Load().(Actors)
+}
+
+func (s Store) SetActors(a Actors) {
+	s.actors.Store(a)
+}
+
+func (s Store) ClockPolicy() ClockPolicy {
+	return s.clocks.Load().(ClockPolicy)
+}
+
+func (s Store) SetClockPolicy(p ClockPolicy) {
+	s.clocks.Store(p)
+}
+
+// clientClock decodes and checks the clock a client sent. No clock at all
+// is a fresh one: the client hasn't seen the key.
+func (s Store) clientClock(packed string) (vclock.VClock, *api.Error) {
+	p := s.ClockPolicy()
+	if packed == "" {
+		return vclock.Fresh(), nil
+	}
+	if len(packed) > p.MaxBytes {
+		return nil, api.NewErrorFmt(api.StatusBadRequest, "X-Mec-Vclock is %d bytes; the most allowed is %d",
+			len(packed), p.MaxBytes).Because(api.ReasonBadVClock, false)
+	}
+	vc, err := parseVClock(packed)
+	switch {
+	case err != nil && p.Strict:
+		return nil, api.NewErrorFmt(api.StatusBadRequest, "X-Mec-Vclock: %v", err).Because(api.ReasonBadVClock, false)
+	case err != nil || vc == nil:
+		// handle the bad VClock input by making a new one
+		return vclock.Fresh(), nil
+	case len(vc) > p.MaxEntries:
+		return nil, api.NewErrorFmt(api.StatusBadRequest, "X-Mec-Vclock has %d entries; the most allowed is %d",
+			len(vc), p.MaxEntries).Because(api.ReasonBadVClock, false)
+	case p.Strict && !vc.IsValid():
+		return nil, api.NewError(api.StatusBadRequest, "X-Mec-Vclock has an empty actor, or a counter or timestamp that isn't positive").Because(api.ReasonBadVClock, false)
+	}
+	return vc, nil
+}
+
+// replicas lists the healthy nodes holding key's n replicas, and how many
+// replicas there would be with every node healthy. Quorums are capped at
+// the latter so small clusters still work.
+func (s Store) replicas(key string, n int) ([]string, int) {
+	return s.pl.Preferred(key, n), len(s.pl.Ring().Preference(key, n))
+}
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+// Listen answers other nodes' requests until Close. Requests that name a
+// key are handled by Limits.Workers goroutines, sharded by key so that
+// requests for one key happen in the order they arrived while requests for
+// different keys happen in parallel.
 func (w *Store) Listen() {
-	writes := make(chan []string, 1000)
-	(*w).pl.Subscribe(writes, "WRITE")
-	gets := make(chan []string, 1000)
-	(*w).pl.Subscribe(gets, "GET")
+	l := w.limits
+	sh := newShards(l.Workers, shardDepth)
+	keyed := []struct {
+		msgtype string
+		handle  func([]string)
+	}{
+		{"WRITE", w.handleWrite},
+		{"GET", w.handleGet},
+		{"HANDOFF", w.handleHandoff},
+	}
+
+	var workers sync.WaitGroup
+	sh.run(w.quit, &workers)
+	chans := make([]chan []string, 0, len(keyed)+1)
+	for _, k := range keyed {
+		c := make(chan []string, l.Queue)
+		chans = append(chans, c)
+		w.pl.SubscribeRequests(c, k.msgtype)
+		workers.Add(1)
+		go w.dispatch(c, sh, k.handle, &workers)
+	}
+
+	// these only start a transfer in the background
+	transfers := make(chan []string, 10)
+	chans = append(chans, transfers)
+	w.pl.SubscribeRequests(transfers, "TRANSFER")
+	workers.Add(1)
+	go w.serve(transfers, w.handleTransfer, &workers)
+
+	<-w.quit
+	for _, c := range chans {
+		w.pl.Unsubscribe(c)
+	}
+	workers.Wait()
+	close(w.done)
+}
+
+// messages waiting for each shard, beyond those queued by type
+const shardDepth = 16
+
+// dispatch hands each message from c to its key's shard, telling the
+// sender BUSY if the shard is full
+func (w *Store) dispatch(c chan []string, sh *shards, handle func([]string), wg *sync.WaitGroup) {
+	defer wg.Done()
 	for {
 		select {
-		case msg := <-writes:
-			// fmt.Printf("store received: %v\n", msg)
-			key, value, content_type, vc, err := parseWriteMsg(false, msg...)
-			if err != nil {
-				// handle error
-				// or just silently drop?
-			} else {
-				err = w.DBWrite(key, value, content_type, vc)
-				if err != nil {
-					// reply with fail
+		case <-w.quit:
+			return
+		case msg := <-c:
+			// routing frame, type, key
+			if len(msg) < 3 {
+				if len(msg) > 0 {
 					w.pl.Reply(msg[0], "FAIL")
-				} else {
-					w.pl.Reply(msg[0], "GOOD")
 				}
-			}
-		case msg := <-gets:
-			// Respond to GET messages with FAIL or DATA
-			key := parseGetMsg(false, msg...)
-			value, content_type, vc, err := w.DBRead(key)
-			if err != nil {
-				w.pl.Reply(msg[0], "FAIL")
 				continue
 			}
-			r, err := encodeDataMsg("DATA", key, value, content_type, vc)
-			if err != nil {
-				w.pl.Reply(msg[0], "FAIL")
-				continue
+			if !sh.dispatch(msg[2], job{msg, handle}) {
+				peers.Shed(msg[1])
+				w.pl.Reply(msg[0], "BUSY")
 			}
-			reply := append([]string{msg[0]}, r...)
-			w.pl.Reply(reply...)
 		}
 	}
 }
 
-// APIWrite takes a client request and distributes it to itself and W-1 servers.
-func (s Store) APIWrite(key, value, content_type, client_id, packed_vclock string) (string, *api.Error) {
-	vc, err := parseVClock(packed_vclock)
+// serve handles messages from c one at a time until Close
+func (w *Store) serve(c chan []string, handle func([]string), wg *sync.WaitGroup) {
+	defer wg.Done()
+	for {
+		select {
+		case <-w.quit:
+			return
+		case msg := <-c:
+			handle(msg)
+		}
+	}
+}
+
+func (w *Store) handleWrite(msg []string) {
+	sp := trace.FromFrames("replica write", optionFrames(msg, writeFrames))
+	defer sp.End()
+	key, v, err := parseWriteMsg(false, msg...)
+	sp.Set("key", key)
+	if w.Leaving() {
+		// whoever sent it hasn't heard; they'll find the new owners
+		sp.Fail("leaving")
+		w.pl.Reply(msg[0], "FAIL")
+	} else if err != nil {
+		// handle error
+		// or just silently drop?
+		sp.Fail(err.Error())
+	} else {
+		put := sp.Child("leveldb merge", trace.Internal)
+		st, err := w.DBMerge(key, storableOf([]Version{v}))
+		put.End()
+		var r []string
+		if err == nil && hasOption(optionFrames(msg, writeFrames), returnBodyFrame) {
+			r, err = encodeDataReply("GOOD", key, st)
+		}
+		if err != nil {
+			// reply with fail
+			sp.Fail(err.Error())
+			w.pl.Reply(msg[0], "FAIL")
+		} else if r != nil {
+			w.pl.Reply(append([]string{msg[0]}, r...)...)
+		} else {
+			w.pl.Reply(msg[0], "GOOD")
+		}
+	}
+}
+
+// Respond to GET messages with FAIL or DATA
+func (w *Store) handleGet(msg []string) {
+	sp := trace.FromFrames("replica read", optionFrames(msg, getFrames))
+	defer sp.End()
+	key := parseGetMsg(false, msg...)
+	sp.Set("key", key)
+	get := sp.Child("leveldb get", trace.Internal)
+	st, found, err := w.load(key)
+	get.End()
+	if err != nil || !found {
+		sp.Set("found", false)
+		w.pl.Reply(msg[0], "FAIL")
+		return
+	}
+	sp.Set("siblings", len(st.Siblings))
+	r, err := encodeDataReply("DATA", key, st)
 	if err != nil {
-		// handle the bad VClock input by making a new one
-		vc = vclock.Fresh()
+		sp.Fail(err.Error())
+		w.pl.Reply(msg[0], "FAIL")
+		return
+	}
+	reply := append([]string{msg[0]}, r...)
+	w.pl.Reply(reply...)
+}
+
+func (w *Store) handleHandoff(msg []string) {
+	sp := trace.FromFrames("replica handoff", optionFrames(msg, handoffFrames))
+	defer sp.End()
+	key, st, err := parseHandoffMsg(false, msg...)
+	sp.Set("key", key)
+	if err == nil {
+		err = w.acceptHandoff(key, st)
+	}
+	if err != nil {
+		sp.Fail(err.Error())
+		w.pl.Reply(msg[0], "FAIL")
+	} else {
+		w.pl.Reply(msg[0], "GOOD")
+	}
+}
+
+// these take a while; the claimant just wants to know we're on it
+func (w *Store) handleTransfer(msg []string) {
+	ts, err := parseTransferMsg(false, msg...)
+	if err != nil {
+		w.pl.Reply(msg[0], "FAIL")
+		return
+	}
+	w.pl.Reply(msg[0], "GOOD")
+	w.work.Add(1)
+	go func() {
+		defer w.work.Done()
+		w.Transfer(ts)
+	}()
+}
+
+// Close stops answering other nodes, waits for the messages being handled
+// and any transfers to finish (they give up early), and syncs the
+// database's log to disk. The database itself is the caller's to close.
+func (s Store) Close() error {
+	close(s.quit)
+	<-s.done
+	s.work.Wait()
+
+	wo := levigo.NewWriteOptions()
+	wo.SetSync(true)
+	defer wo.Close()
+	wb := levigo.NewWriteBatch()
+	defer wb.Close()
+	return s.db.Write(wo, wb)
+}
+
+func (s Store) closing() bool {
+	select {
+	case <-s.quit:
+		return true
+	default:
+		return false
+	}
+}
+
+// StopWrites makes this node refuse writes from now on, while it hands its
+// data to other nodes.
+func (s Store) StopWrites() {
+	atomic.StoreInt32(s.leaving, 1)
+}
+
+func (s Store) Leaving() bool {
+	return atomic.LoadInt32(s.leaving) == 1
+}
+
+// DBProperty is one of LevelDB's properties, eg "leveldb.stats"
+func (s Store) DBProperty(name string) string {
+	return s.db.PropertyValue(name)
+}
+
+// ApproximateSize is roughly how much disk the keys take up. It leaves out
+// keys starting with 0xff, which can't be valid UTF-8 anyway.
+func (s Store) ApproximateSize() uint64 {
+	sizes := s.db.GetApproximateSizes([]levigo.Range{{Start: []byte{}, Limit: []byte{0xff}}})
+	if len(sizes) != 1 {
+		return 0
+	}
+	return sizes[0]
+}
+
+// Handoff offers every key in the database to the nodes that hold it in r,
+// and returns how many keys were taken and how many nobody acknowledged.
+func (s Store) Handoff(r *ring.Ring) (int, int) {
+	ro := levigo.NewReadOptions()
+	ro.SetFillCache(false)
+	defer ro.Close()
+	it := s.db.NewIterator(ro)
+	defer it.Close()
+
+	sent, failed := 0, 0
+	for it.SeekToFirst(); it.Valid(); it.Next() {
+		key := string(it.Key())
+		msg := encodeHandoffMsg(key, it.Value())
+		targets := r.Preference(key, s.Quorum().N)
+
+		acked := 0
+		for i := 0; i < handoffAttempts && acked == 0; i++ {
+			acked = s.pl.VerifyAll(targets, msg...)
+		}
+		if acked == 0 {
+			log.Warn("handoff failed", "key", key)
+			failed += 1
+		} else {
+			sent += 1
+		}
+	}
+	if err := it.GetError(); err != nil {
+		log.Error("handoff iterator", "err", err)
+		failed += 1
+	}
+	return sent, failed
+}
+
+// Transfer hands the keys in each transfer's partition to its new node.
+func (s Store) Transfer(ts []ring.Transfer) (int, int) {
+	targets := make(map[int][]string)
+	for _, t := range ts {
+		targets[t.Partition] = append(targets[t.Partition], t.To)
+	}
+
+	ro := levigo.NewReadOptions()
+	ro.SetFillCache(false)
+	defer ro.Close()
+	it := s.db.NewIterator(ro)
+	defer it.Close()
+
+	sent, failed := 0, 0
+	for it.SeekToFirst(); it.Valid() && !s.closing(); it.Next() {
+		key := string(it.Key())
+		to, ok := targets[ring.Partition(key)]
+		if !ok {
+			continue
+		}
+		msg := encodeHandoffMsg(key, it.Value())
+		acked := 0
+		for i := 0; i < handoffAttempts && acked < len(to); i++ {
+			acked = s.pl.VerifyAll(to, msg...)
+		}
+		if acked < len(to) {
+			log.Warn("transfer failed", "key", key, "to", to)
+			failed += 1
+		} else {
+			sent += 1
+		}
+	}
+	log.Info("transfer finished", "sent", sent, "failed", failed)
+	return sent, failed
+}
+
+// acceptHandoff merges a key handed to us by a leaving node into ours
+func (s Store) acceptHandoff(key string, st Storable) error {
+	_, err := s.DBMerge(key, st)
+	return err
+}
+
+// APIWrite takes a client request and distributes it to itself and W-1
+// servers. With returnbody it also gives back what the replicas that took
+// the write hold afterwards, siblings and all, and a clock for all of it.
+func (s Store) APIWrite(sp *trace.Span, key, value, content_type, client_id, packed_vclock string, returnbody bool) (MaybeMulti, string, *api.Error) {
+	vc, err_clock := s.clientClock(packed_vclock)
+	if err_clock != nil {
+		return MaybeMulti{}, packed_vclock, err_clock
 	}
 
-	vc.Increment(client_id)
+	v := Version{value, content_type, vc, Dot{}}
+	if s.Actors() == ClientActors {
+		if client_id == "" && s.ClockPolicy().Strict {
+			return MaybeMulti{}, packed_vclock, api.NewError(api.StatusBadRequest, "X-Mec-Client-ID is required")
+		}
+		v.VC.Increment(client_id)
+	} else {
+		// held until the write is done, so this node's writes of a key
+		// reach the replicas in the order their counters say
+		unlock := s.writing.lock(key)
+		defer unlock()
+		v.Dot = s.nextDot(vc)
+		sp.Set("dot", v.Dot.Counter)
+	}
 
-	err_write := s.DistributeWrite(key, value, content_type, vc)
+	written, err_write := s.DistributeWrite(sp, key, v, returnbody)
 	if err_write != nil {
 		// nothing happened, give back the original clock
-		return packed_vclock, err_write
+		return MaybeMulti{}, packed_vclock, err_write
 	}
 
+	maybe, vc := writeResult(v, written, returnbody)
 	b64, err := encodeVClock(vc)
 	if err != nil {
-		return packed_vclock, nil
+		return maybe, packed_vclock, nil
 	}
 
-	return b64, nil // default OK response returned.
+	return maybe, b64, nil // default OK response returned.
 }
 
-func (s Store) DistributeWrite(key, value, content_type string, vc vclock.VClock) *api.Error {
-	msg, err := encodeWriteMsg(key, value, content_type, vc)
+// nextDot takes a counter for a write this node coordinates, higher than
+// any it has taken before and any in the client's clock. The write keeps
+// the client's clock as it is, as what the client had seen: a version the
+// client hadn't seen, even one with a lower counter from this node, stays
+// as a sibling instead of looking like an ancestor.
+func (s Store) nextDot(seen vclock.VClock) Dot {
+	self := s.pl.Name
+	for {
+		last := atomic.LoadInt64(s.dots)
+		next := last + 1
+		if c := int64(seen[self].Counter); c >= next {
+			next = c + 1
+		}
+		if atomic.CompareAndSwapInt64(s.dots, last, next) {
+			return Dot{self, int(next), time.Now().UnixNano()}
+		}
+	}
+}
+
+// writeResult is what a client is told after writing v: what the replicas
+// that took it hold, if they said, and a clock for all of it
+func writeResult(v Version, written []Version, returnbody bool) (MaybeMulti, vclock.VClock) {
+	switch {
+	case len(written) > 0:
+		return maybeOf(reconcile(written))
+	case returnbody:
+		// replicas too old to send their state back; ours is all we know
+		return maybeOf([]Version{v})
+	}
+	return MaybeMulti{}, v.clock()
+}
+
+// DistributeWrite sends a write to key's replicas and waits for W of them.
+// With returnbody, it gives back every version the replicas that took it
+// hold afterwards.
+func (s Store) DistributeWrite(sp *trace.Span, key string, v Version, returnbody bool) ([]Version, *api.Error) {
+	msg, err := encodeWriteMsg(key, v)
 	if err != nil {
-		return api.NewError(api.StatusBadGateway, "couldn't distribute write")
+		return nil, api.NewError(api.StatusBadGateway, "couldn't distribute write").Because(api.ReasonInternal, false)
 		// fail here so we don't send unintelligible messages
 	}
-	n := s.pl.VerifyRandom(W, msg...)
-	if n == 0 {
-		return api.NewError(api.StatusBadGateway, "no successful writes")
-		// if we at least get one, treat that as a success.
+	if returnbody {
+		msg = append(msg, returnBodyFrame)
 	}
-	return nil
+	defer quorumDuration.With("write").ObserveSince(time.Now())
+	qs := sp.Child("quorum write", trace.Internal)
+	defer qs.End()
+	q := s.Quorum()
+	nodes, total := s.replicas(key, q.N)
+	w := minInt(q.W, total)
+	qs.Set("key", key)
+	qs.Set("w", w)
+	l := s.logger(key)
+	replies := s.pl.WithSpan(qs).WithLog(s.keyLog(key)).MultiMessageExpectResponse(nodes, s.pl.Timeout(), msg...)
+	written, err_write := writeQuorum(qs, nodes, replies, w)
+	if err_write != nil {
+		l.Warn("write failed", "err", err_write.Error(), "replies", len(replies), "replicas", len(nodes))
+	}
+	return written, err_write
 }
 
-// Write to the database
-func (s Store) DBWrite(key, value, content_type string, vc vclock.VClock) error {
-	fmt.Printf("will write: %v \"%v\" %v %v\n", key, value, content_type, vc)
-	obj, err := encodeStorable(Storable{value, content_type, vc})
-	if err != nil {
-		fmt.Printf("write failed: %v", err)
-		return err
+// writeQuorum counts the replies to a write and decides how it went: 503 if
+// it fell short because replicas were too busy, which is worth retrying,
+// and 502 otherwise.
+func writeQuorum(qs *trace.Span, nodes []string, replies map[string][]string, w int) ([]Version, *api.Error) {
+	n, busy := 0, 0
+	var written []Version
+	for _, reply := range replies {
+		switch {
+		case len(reply) == 0:
+		case reply[0] == "GOOD":
+			n += 1
+			if vs, err := parseDataReply(reply...); err == nil {
+				written = append(written, vs...)
+			}
+		case reply[0] == "BUSY":
+			busy += 1
+		}
+	}
+	qs.Set("acks", n)
+	if n < w || n == 0 {
+		got := api.Quorum{Op: "write", Wanted: w, Achieved: n, Failed: failed(nodes, replies, "GOOD")}
+		switch {
+		case busy > 0:
+			quorums.With("write", "overloaded").Inc()
+			qs.Fail("replicas overloaded")
+			return nil, api.NewErrorFmt(api.StatusServiceUnavailable, "%d of %d replicas too busy to write", busy, len(nodes)).WithQuorum(got)
+		case n == 0:
+			quorums.With("write", "failed").Inc()
+			qs.Fail("no successful writes")
+			return nil, api.NewError(api.StatusBadGateway, "no successful writes").WithQuorum(got)
+		default:
+			quorums.With("write", "partial").Inc()
+			qs.Fail("quorum not reached")
+			return nil, api.NewErrorFmt(api.StatusBadGateway, "only %d of %d writes succeeded", n, w).WithQuorum(got)
+		}
 	}
+	quorums.With("write", "ok").Inc()
+	return written, nil
+}
 
-	err = s.db.Put(s.wo, []byte(key), obj)
-	if err != nil {
-		fmt.Printf("write failed: %v", err)
-		return err
+// failed lists the nodes that didn't reply with one of ok
+func failed(nodes []string, replies map[string][]string, ok ...string) []string {
+	var acc []string
+	for _, node := range nodes {
+		reply := replies[node]
+		good := false
+		for _, o := range ok {
+			good = good || (len(reply) > 0 && reply[0] == o)
+		}
+		if !good {
+			acc = append(acc, node)
+		}
 	}
-	return nil
+	return acc
 }
 
 type ReadValue struct {
 	Value        string
 	Content_Type string
 	Timestamp    int64
+	Vtag         string // names this value among its siblings
 }
 
 func (r ReadValue) EqualTo(other ReadValue) bool {
@@ -158,14 +700,31 @@ type MaybeMulti struct {
 	Multiple []ReadValue // if not Multi then == nil
 }
 
+// Find picks out the value with the given vtag
+func (m MaybeMulti) Find(vtag string) (ReadValue, bool) {
+	if !m.Multi {
+		return m.Single, m.Single.Vtag == vtag
+	}
+	for _, rv := range m.Multiple {
+		if rv.Vtag == vtag {
+			return rv, true
+		}
+	}
+	return ReadValue{}, false
+}
+
 // APIRead returns value for key + a base64-encoded VClock
-func (s Store) APIRead(key, client_id string) (MaybeMulti, string, *api.Error) {
-	maybe, vc, err_read := s.DistributeRead(key)
+func (s Store) APIRead(sp *trace.Span, key, client_id string) (MaybeMulti, string, *api.Error) {
+	maybe, vc, err_read := s.DistributeRead(sp, key)
 	b64, err := encodeVClock(vc)
 	if err_read != nil {
 		return maybe, b64, err_read
 	}
 	if err != nil {
+		if s.ClockPolicy().Strict {
+			s.logger(key).Error("couldn't encode vclock", "err", err)
+			return maybe, "", api.NewError(api.StatusInternalServerError, "couldn't encode the key's vclock")
+		}
 		b64, _ = encodeVClock(vclock.Fresh())
 		return maybe, b64, nil
 	}
@@ -174,145 +733,152 @@ func (s Store) APIRead(key, client_id string) (MaybeMulti, string, *api.Error) {
 }
 
 // Performs a Read-Repair on the key and returns a merged value
-func (s Store) DistributeRead(key string) (MaybeMulti, vclock.VClock, *api.Error) {
+func (s Store) DistributeRead(sp *trace.Span, key string) (MaybeMulti, vclock.VClock, *api.Error) {
 	msg := encodeGetMsg(key)
-	responses, _ := s.pl.RandomResponses(R, msg...)
-
-	data := make(map[string]ReadValue, 0)         // map responses to returnable values
-	clockmap := make(map[string]vclock.VClock, 0) // map responses to vclocks
+	defer quorumDuration.With("read").ObserveSince(time.Now())
+	qs := sp.Child("quorum read", trace.Internal)
+	qs.Set("key", key)
+	q := s.Quorum()
+	nodes, total := s.replicas(key, q.N)
+	l := s.logger(key)
+	responses := s.pl.WithSpan(qs).WithLog(s.keyLog(key)).MultiMessageExpectResponse(nodes, s.pl.Timeout(), msg...)
+	qs.Set("replies", len(responses))
+	err := readQuorum(qs, nodes, responses, minInt(q.R, total))
+	qs.End()
+	if err != nil {
+		l.Warn("read failed", "err", err.Error(), "replies", len(responses), "replicas", len(nodes))
+		return MaybeMulti{}, nil, err
+	}
 
-	// take vclock for each response into clockmap
-	for k, msg := range responses {
-		// don't keep failed responses around
-		_, v, c, vc, err := parseDataMsg(true, msg...)
-		if msg[0] == "FAIL" || err != nil {
-			delete(responses, k)
+	// every version each replica holds; a FAIL holds nothing
+	held := make(map[string][]Version, len(responses))
+	all := make([]Version, 0, len(responses))
+	for node, reply := range responses {
+		vs, err := parseDataReply(reply...)
+		if err != nil {
 			continue
 		}
-		clockmap[k] = vc
-		data[k] = ReadValue{v, c, vc.MaxTimestamp()}
+		held[node] = vs
+		all = append(all, vs...)
 	}
 
-	// reassign to number of SUCCESSFUL responses.
-	n := len(responses)
-
-	if n == 0 {
+	if len(held) == 0 {
+		quorums.With("read", "not_found").Inc()
 		return MaybeMulti{}, nil, api.NewError(api.StatusNotFound, "no successful reads")
 	}
+	quorums.With("read", "ok").Inc()
 
-	if n == 1 {
-		var v []string
-		for _, a := range responses {
-			v = a
-		}
-		_, value, content_type, clock, err := parseDataMsg(true, v...)
-		if err != nil {
-			return MaybeMulti{}, nil, api.NewError(api.StatusNotFound, "no successful reads")
-		}
-		single := MaybeMulti{
-			false,
-			ReadValue{value, content_type, clock.MaxTimestamp()},
-			nil,
+	latest := reconcile(all)
+	s.repair(sp, key, held, latest)
+
+	siblings.Observe(float64(len(latest)))
+	if len(latest) > 1 {
+		siblingReads.Inc()
+	}
+	maybe, vc := maybeOf(latest)
+	return maybe, vc, nil
+}
+
+// readQuorum checks enough replicas answered a read, dropping the BUSY
+// replies from responses: a FAIL is an answer too, that replica doesn't
+// have the key, but BUSY isn't. Falling short is 503 if replicas were too
+// busy, and 504 otherwise.
+func readQuorum(qs *trace.Span, nodes []string, responses map[string][]string, r int) *api.Error {
+	busy := 0
+	for k, reply := range responses {
+		if len(reply) > 0 && reply[0] == "BUSY" {
+			delete(responses, k)
+			busy += 1
 		}
-		return single, clock, nil // it's not an error when there's only one DB
 	}
+	if len(responses) >= r {
+		return nil
+	}
+	got := api.Quorum{Op: "read", Wanted: r, Achieved: len(responses), Failed: failed(nodes, responses, "DATA", "FAIL")}
+	if busy > 0 {
+		quorums.With("read", "overloaded").Inc()
+		qs.Fail("replicas overloaded")
+		return api.NewErrorFmt(api.StatusServiceUnavailable, "%d of %d replicas too busy to read", busy, len(nodes)).WithQuorum(got)
+	}
+	quorums.With("read", "timeout").Inc()
+	qs.Fail("quorum not reached")
+	return api.NewErrorFmt(api.StatusGatewayTimeout, "only %d of %d replicas answered", len(responses), r).WithQuorum(got)
+}
 
-	// get map of responses to the latest (potentially sibling) clocks
-	latest := vclock.Latest(clockmap)
-	// clocks makes it convenient to do ops on clocks
+// maybeOf turns reconciled versions into what a client sees, and the clock
+// it should send back
+func maybeOf(latest []Version) (MaybeMulti, vclock.VClock) {
+	if len(latest) == 1 {
+		v := latest[0]
+		vc := v.clock()
+		rv := ReadValue{v.Value, v.Content_Type, vc.MaxTimestamp(), v.vtag()}
+		return MaybeMulti{false, rv, nil}, vc
+	}
+
+	// we have siblings! give the client a clock descending all of them, so
+	// its next write resolves them
 	clocks := make([]vclock.VClock, len(latest))
-	i := 0
-	for _, v := range latest {
-		clocks[i] = v
-		i++
-	}
-
-	if len(latest) > 1 && !vclock.AllEqual(clocks) {
-		// we have siblings!
-		// get a merged clock to return to client
-		merged := vclock.Merge(clocks)
-		// get a list of returnable values in admittedly random order
-		reads := make([]ReadValue, len(latest))
-		i := 0
-		for k, _ := range latest {
-			reads[i] = data[k]
-			i++
+	returnables := make([]ReadValue, 0, len(latest))
+	for i, v := range latest {
+		clocks[i] = v.clock()
+		rv := ReadValue{v.Value, v.Content_Type, clocks[i].MaxTimestamp(), v.vtag()}
+		dup := false
+		for _, r := range returnables {
+			dup = dup || r.EqualTo(rv)
 		}
-		returnables := make([]ReadValue, 0)
-		returnables = append(returnables, reads[0])
-		for i, a := range reads[:len(reads) - 1] {
-			for _, b := range reads[i+1:] {
-				if !a.EqualTo(b) {
-					returnables = append(returnables, b)
-				}
-			}
+		if !dup {
+			returnables = append(returnables, rv)
 		}
+	}
+	multi := MaybeMulti{Multi: true, Single: ReadValue{}, Multiple: returnables}
+	return multi, vclock.Merge(clocks)
+}
 
-		multi := MaybeMulti{Multi: true, Single: ReadValue{}, Multiple: returnables}
-		return multi, merged, nil
-	} else {
-		// now we have a list of equivalent, up-to-date clocks, pick one
-		var (
-			nodename                 string
-			key, value, content_type string
-			err						 error
-			clock                    vclock.VClock
-		)
-
-		// assign values to our good response
-		i := len(latest)
-		for k, v := range latest {
-			nodename, clock = k, v
-			key, value, content_type, _, err = parseDataMsg(true, responses[nodename]...)
-			if err != nil {
-				if i == len(latest) {
-					// basically we really screwed up to get this far
-					return MaybeMulti{}, nil, api.NewError(api.StatusInternalServerError, "unparseable reads")
-				}
+// repair sends each replica that answered the versions in latest it's
+// missing. Replicas merge what they're sent, so a repair can't undo a write
+// that got there first.
+func (s Store) repair(sp *trace.Span, key string, held map[string][]Version, latest []Version) {
+	for node, vs := range held {
+		var msgs [][]string
+		for _, v := range latest {
+			if holds(vs, v) {
 				continue
 			}
-		}
-
-		outdated := vclock.MapOutdated(clockmap)
-
-		// this is our 'good response'
-		for i, node := range outdated {
-
-			msg, err := encodeWriteMsg(key, value, content_type, clock)
+			msg, err := encodeWriteMsg(key, v)
 			if err != nil {
-				if i == len(outdated) {
-					return MaybeMulti{}, nil, api.NewError(500, "unparseable")
-				}
 				continue
 			}
-
-			go s.pl.MessageExpectResponse(node, msg...)
-			// If they are unable to repair...
-			// Who cares? That's not my fault.
+			msgs = append(msgs, msg)
+		}
+		if len(msgs) == 0 {
+			continue
 		}
 
-		rv := ReadValue{value, content_type, clock.MaxTimestamp()}
-		maybe := MaybeMulti{false, rv, nil}
-
-		return maybe, clock, nil
+		readRepairs.Inc()
+		repair := sp.Child("read repair", trace.Internal)
+		repair.Set("key", key)
+		repair.Set("peer", node)
+		repair.Set("versions", len(msgs))
+		s.logger(key).Debug("read repair", "peer", node, "versions", len(msgs))
+		go func(node string, msgs [][]string) {
+			for _, msg := range msgs {
+				s.pl.WithSpan(repair).WithLog(s.keyLog(key)).MultiMessageExpectResponse([]string{node}, s.pl.Timeout(), msg...)
+			}
+			repair.End()
+		}(node, msgs)
+		// If they are unable to repair...
+		// Who cares? That's not my fault.
 	}
-
-	// That should repair everything.
-	// And we never get here
-
-	return MaybeMulti{}, nil, nil
 }
 
-// Write to the database
+// Read from the database: the newest of key's values, ignoring siblings
 func (s Store) DBRead(key string) (string, string, vclock.VClock, error) {
-	obj, err := s.db.Get(s.ro, []byte(key))
+	st, found, err := s.load(key)
 	if err != nil {
 		return "", "", nil, err
 	}
-	st, err := decodeStorable(obj)
-	if err != nil {
-		return "", "", nil, err
+	if !found {
+		return "", "", nil, errors.New("not found")
 	}
-
-	return st.Value, st.Content_Type, st.VC, nil
+	return st.Value, st.Content_Type, st.versions()[0].clock(), nil
 }
@@ -0,0 +1,191 @@
+package store
+
+import (
+	"bytes"
+	api "github.com/cormacrelf/mec-db/api/apierrors"
+	"github.com/cormacrelf/mec-db/logging"
+	"github.com/cormacrelf/mec-db/peers"
+	"github.com/cormacrelf/mec-db/vclock"
+	"github.com/jmhodges/levigo"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+// tempStore is a Store on a fresh database that answers as node name, but
+// isn't listening for other nodes
+func tempStore(t testing.TB, name string) *Store {
+	dir, err := ioutil.TempDir("", "mec-store")
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts := levigo.NewOptions()
+	opts.SetCreateIfMissing(true)
+	db, err := levigo.Open(dir, opts)
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		db.Close()
+		os.RemoveAll(dir)
+	})
+	return newStore(db, &peers.PeerList{Name: name}, DefaultQuorum, DefaultLimits)
+}
+
+// write is what a replica does with a write s coordinated
+func write(t testing.TB, s *Store, key, value string, seen vclock.VClock) Storable {
+	v := Version{value, "text/plain", seen, s.nextDot(seen)}
+	st, err := s.DBMerge(key, storableOf([]Version{v}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return st
+}
+
+func TestBlindWritesMakeSiblings(t *testing.T) {
+	s := tempStore(t, "lion")
+	write(t, s, "k", "first", vclock.Fresh())
+	st := write(t, s, "k", "second", vclock.Fresh())
+	if vs := st.versions(); len(vs) != 2 {
+		t.Fatalf("two blind writes through one node left %d versions, want 2 siblings", len(vs))
+	}
+
+	// a client that read both resolves them
+	_, vc := maybeOf(reconcile(st.versions()))
+	st = write(t, s, "k", "resolved", vc)
+	if vs := st.versions(); len(vs) != 1 || vs[0].Value != "resolved" {
+		t.Errorf("a write that had seen both siblings left %v", vs)
+	}
+
+	// and one that hadn't seen it doesn't lose its write
+	st = write(t, s, "k", "late", vc)
+	if vs := st.versions(); len(vs) != 2 {
+		t.Errorf("a write concurrent with the resolution left %v", vs)
+	}
+}
+
+func withPolicy(p ClockPolicy) Store {
+	s := Store{clocks: &atomic.Value{}}
+	s.SetClockPolicy(p)
+	return s
+}
+
+func TestClientClockLimits(t *testing.T) {
+	packed := func(vc vclock.VClock) string {
+		enc, err := encodeVClock(vc)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return enc
+	}
+	crowded := vclock.Fresh()
+	for _, a := range []string{"a", "b", "c", "d", "e"} {
+		crowded[a] = vclock.Entry{Counter: 1, Timestamp: 1}
+	}
+	invalid := packed(vclock.VClock{"a": {Counter: 0, Timestamp: 1}})
+
+	for _, strict := range []bool{true, false} {
+		s := withPolicy(ClockPolicy{Strict: strict, MaxBytes: 512, MaxEntries: 4})
+
+		vc, err := s.clientClock("")
+		if err != nil || vc == nil || len(vc) != 0 {
+			t.Errorf("strict %v: no clock should be a fresh one, got %v, %v", strict, vc, err)
+		}
+
+		_, err = s.clientClock(strings.Repeat("A", 513))
+		if err == nil || err.Code != api.StatusBadRequest || err.Reason != api.ReasonBadVClock {
+			t.Errorf("strict %v: accepted a clock over the size limit: %v", strict, err)
+		}
+
+		_, err = s.clientClock(packed(crowded))
+		if err == nil || err.Code != api.StatusBadRequest || err.Reason != api.ReasonBadVClock {
+			t.Errorf("strict %v: accepted a clock with too many entries: %v", strict, err)
+		}
+
+		vc, err = s.clientClock("not a clock!")
+		switch {
+		case strict && (err == nil || err.Code != api.StatusBadRequest || err.Reason != api.ReasonBadVClock):
+			t.Errorf("strict: accepted an undecodable clock: %v, %v", vc, err)
+		case !strict && (err != nil || vc == nil || len(vc) != 0):
+			t.Errorf("lenient: an undecodable clock should be a fresh one, got %v, %v", vc, err)
+		}
+
+		vc, err = s.clientClock(invalid)
+		switch {
+		case strict && (err == nil || err.Code != api.StatusBadRequest || err.Reason != api.ReasonBadVClock):
+			t.Errorf("strict: accepted an invalid clock: %v, %v", vc, err)
+		case !strict && (err != nil || len(vc) != 1):
+			t.Errorf("lenient: an invalid clock should pass as it is, got %v, %v", vc, err)
+		}
+	}
+}
+
+func TestClientIDRequired(t *testing.T) {
+	s := withPolicy(DefaultClockPolicy)
+	s.actors = &atomic.Value{}
+	s.SetActors(ClientActors)
+	_, _, err := s.APIWrite(nil, "a", "value", "text/plain", "", "", false)
+	if err == nil || err.Code != api.StatusBadRequest {
+		t.Errorf("a write without X-Mec-Client-ID got %v", err)
+	}
+}
+
+func TestBusyReplicas(t *testing.T) {
+	nodes := []string{"a", "b", "c"}
+	busy := map[string][]string{"a": {"BUSY"}, "b": {"BUSY"}, "c": {}}
+
+	if _, err := writeQuorum(nil, nodes, copyReplies(busy), 2); err == nil || err.Code != api.StatusServiceUnavailable || !err.Retryable {
+		t.Errorf("busy write got %+v", err)
+	}
+	if err := readQuorum(nil, nodes, copyReplies(busy), 2); err == nil || err.Code != api.StatusServiceUnavailable || !err.Retryable {
+		t.Errorf("busy read got %+v", err)
+	}
+
+	// nobody busy, just slow
+	slow := map[string][]string{"a": {"FAIL"}}
+	if _, err := writeQuorum(nil, nodes, copyReplies(slow), 1); err == nil || err.Code != api.StatusBadGateway {
+		t.Errorf("failed write got %+v", err)
+	}
+	if err := readQuorum(nil, nodes, copyReplies(slow), 2); err == nil || err.Code != api.StatusGatewayTimeout {
+		t.Errorf("slow read got %+v", err)
+	}
+
+	// a FAIL still counts towards a read
+	if err := readQuorum(nil, nodes, map[string][]string{"a": {"FAIL"}, "b": {"BUSY"}}, 1); err != nil {
+		t.Errorf("read with an answer got %+v", err)
+	}
+}
+
+func copyReplies(m map[string][]string) map[string][]string {
+	c := make(map[string][]string, len(m))
+	for k, v := range m {
+		c[k] = v
+	}
+	return c
+}
+
+func TestRequestLog(t *testing.T) {
+	var b bytes.Buffer
+	logging.Configure(&b, logging.Info, false)
+	defer logging.Configure(os.Stderr, logging.Info, false)
+
+	s := withPolicy(DefaultClockPolicy)
+	s.WithLog(logging.With("request", "5eed")).logger("album").Warn("write failed")
+	s.logger("artist").Warn("write failed")
+
+	lines := strings.Split(strings.TrimSpace(b.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("logged %q", b.String())
+	}
+	for _, want := range []string{"request=5eed", "key=album", "component=store"} {
+		if !strings.Contains(lines[0], want) {
+			t.Errorf("missing %q in %q", want, lines[0])
+		}
+	}
+	if strings.Contains(lines[1], "request=") || !strings.Contains(lines[1], "key=artist") {
+		t.Errorf("without a request logged %q", lines[1])
+	}
+}
@@ -0,0 +1,276 @@
+package trace
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	queueSize   = 4096
+	batchSize   = 512
+	flushEvery  = time.Second
+	serviceName = "mec"
+)
+
+// An Exporter sends a batch of spans, as an OTLP JSON
+// ExportTraceServiceRequest, somewhere.
+type Exporter interface {
+	Export(body []byte) error
+}
+
+type fileExporter struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+// FileExporter appends each batch to path as a line of JSON, the layout
+// the OpenTelemetry collector's file receiver reads.
+func FileExporter(path string) (Exporter, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &fileExporter{w: f}, nil
+}
+
+func (e *fileExporter) Export(body []byte) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	_, err := e.w.Write(append(body, '\n'))
+	return err
+}
+
+type httpExporter struct {
+	url    string
+	client *http.Client
+}
+
+// HTTPExporter posts each batch to an OTLP/HTTP endpoint, eg a collector
+// on http://localhost:4318/v1/traces
+func HTTPExporter(url string) Exporter {
+	return &httpExporter{url, &http.Client{Timeout: 5 * time.Second}}
+}
+
+func (e *httpExporter) Export(body []byte) error {
+	res, err := e.client.Post(e.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	if res.StatusCode/100 != 2 {
+		return fmt.Errorf("collector said %s", res.Status)
+	}
+	return nil
+}
+
+// ParseDestination makes an Exporter from a config value: a URL for a
+// collector, or file:/path.
+func ParseDestination(dest string) (Exporter, error) {
+	switch {
+	case strings.HasPrefix(dest, "file:"):
+		return FileExporter(strings.TrimPrefix(dest, "file:"))
+	case strings.HasPrefix(dest, "http://"), strings.HasPrefix(dest, "https://"):
+		return HTTPExporter(dest), nil
+	}
+	return nil, errors.New("trace destination should be file:/path or an http(s) URL")
+}
+
+var exporting = struct {
+	sync.Mutex
+	exp     Exporter
+	node    string
+	spans   chan *Span
+	done    chan struct{}
+	dropped int
+}{}
+
+// Configure turns tracing on, exporting this node's spans through exp.
+func Configure(node string, exp Exporter) {
+	exporting.Lock()
+	defer exporting.Unlock()
+	if exporting.exp != nil {
+		return
+	}
+	exporting.exp, exporting.node = exp, node
+	exporting.spans = make(chan *Span, queueSize)
+	exporting.done = make(chan struct{})
+	go export(exporting.spans, exporting.done, exp, node)
+}
+
+// Enabled reports whether spans are being recorded
+func Enabled() bool {
+	exporting.Lock()
+	defer exporting.Unlock()
+	return exporting.exp != nil
+}
+
+// Close exports whatever is queued and turns tracing off
+func Close() {
+	exporting.Lock()
+	spans, done := exporting.spans, exporting.done
+	exporting.exp, exporting.spans = nil, nil
+	exporting.Unlock()
+	if spans != nil {
+		close(spans)
+		<-done
+	}
+}
+
+// queue hands a finished span to the exporter, dropping it rather than
+// making the request wait if the exporter has fallen behind.
+func queue(sp *Span) {
+	exporting.Lock()
+	defer exporting.Unlock()
+	if exporting.spans == nil {
+		return
+	}
+	select {
+	case exporting.spans <- sp:
+	default:
+		exporting.dropped += 1
+	}
+}
+
+func export(spans chan *Span, done chan struct{}, exp Exporter, node string) {
+	defer close(done)
+	tick := time.NewTicker(flushEvery)
+	defer tick.Stop()
+	batch := make([]*Span, 0, batchSize)
+
+	flush := func() {
+		if len(batch) == 0 {
+			return
+		}
+		exporting.Lock()
+		dropped := exporting.dropped
+		exporting.dropped = 0
+		exporting.Unlock()
+		if dropped > 0 {
+			log.Warn("dropped spans; the exporter is behind", "spans", dropped)
+		}
+
+		body, err := json.Marshal(request(node, batch))
+		if err == nil {
+			err = exp.Export(body)
+		}
+		if err != nil {
+			log.Warn("couldn't export spans", "spans", len(batch), "err", err)
+		}
+		batch = batch[:0]
+	}
+
+	for {
+		select {
+		case sp, ok := <-spans:
+			if !ok {
+				flush()
+				return
+			}
+			batch = append(batch, sp)
+			if len(batch) >= batchSize {
+				flush()
+			}
+		case <-tick.C:
+			flush()
+		}
+	}
+}
+
+// OTLP JSON, just the parts we fill in. IDs are hex and times are decimal
+// strings of nanoseconds, as the OTLP JSON encoding has them.
+
+type otlpRequest struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+type otlpResourceSpans struct {
+	Resource   otlpResource     `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpResource struct {
+	Attributes []otlpAttribute `json:"attributes"`
+}
+
+type otlpScopeSpans struct {
+	Scope otlpScope  `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+type otlpScope struct {
+	Name string `json:"name"`
+}
+
+type otlpSpan struct {
+	TraceID           string          `json:"traceId"`
+	SpanID            string          `json:"spanId"`
+	ParentSpanID      string          `json:"parentSpanId,omitempty"`
+	Name              string          `json:"name"`
+	Kind              int             `json:"kind"`
+	StartTimeUnixNano string          `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string          `json:"endTimeUnixNano"`
+	Attributes        []otlpAttribute `json:"attributes,omitempty"`
+	Status            otlpStatus      `json:"status"`
+}
+
+type otlpAttribute struct {
+	Key   string    `json:"key"`
+	Value otlpValue `json:"value"`
+}
+
+type otlpValue struct {
+	StringValue string `json:"stringValue"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code,omitempty"` // 2 is an error
+	Message string `json:"message,omitempty"`
+}
+
+func attribute(k, v string) otlpAttribute {
+	return otlpAttribute{k, otlpValue{v}}
+}
+
+func request(node string, batch []*Span) otlpRequest {
+	spans := make([]otlpSpan, 0, len(batch))
+	for _, sp := range batch {
+		sp.mu.Lock()
+		o := otlpSpan{
+			TraceID:           sp.Trace.String(),
+			SpanID:            sp.ID.String(),
+			Name:              sp.Name,
+			Kind:              sp.Kind,
+			StartTimeUnixNano: strconv.FormatInt(sp.Start.UnixNano(), 10),
+			EndTimeUnixNano:   strconv.FormatInt(sp.end.UnixNano(), 10),
+		}
+		if sp.Parent != (SpanID{}) {
+			o.ParentSpanID = sp.Parent.String()
+		}
+		for k, v := range sp.attrs {
+			o.Attributes = append(o.Attributes, attribute(k, v))
+		}
+		if sp.failed != "" {
+			o.Status = otlpStatus{2, sp.failed}
+		}
+		sp.mu.Unlock()
+		spans = append(spans, o)
+	}
+
+	resource := otlpResource{[]otlpAttribute{
+		attribute("service.name", serviceName),
+		attribute("service.instance.id", node),
+	}}
+	return otlpRequest{[]otlpResourceSpans{{
+		Resource:   resource,
+		ScopeSpans: []otlpScopeSpans{{otlpScope{serviceName}, spans}},
+	}}}
+}
@@ -0,0 +1,43 @@
+package trace
+
+import (
+	"github.com/codegangsta/martini"
+	"github.com/cormacrelf/mec-db/logging"
+	"net/http"
+	"strconv"
+)
+
+var log = logging.With("component", "trace")
+
+// Handler is martini middleware that starts a span for every request,
+// continuing the trace in its traceparent header if there is one, and maps
+// the *Span for handlers to pass on. The span is nil while tracing is off.
+func Handler() martini.Handler {
+	return func(c martini.Context, res http.ResponseWriter, req *http.Request) {
+		sp := Start(req.Method+" "+route(req.URL.Path), Server, req.Header.Get("traceparent"))
+		sp.Set("http.method", req.Method)
+		sp.Set("http.target", req.URL.Path)
+		if sp != nil {
+			res.Header().Set("traceparent", sp.Traceparent())
+		}
+		c.Map(sp)
+		c.Next()
+
+		if rw, ok := res.(martini.ResponseWriter); ok && rw.Status() != 0 {
+			sp.Set("http.status_code", strconv.Itoa(rw.Status()))
+			if rw.Status() >= 500 {
+				sp.Fail(http.StatusText(rw.Status()))
+			}
+		}
+		sp.End()
+	}
+}
+
+// route names a span after the route rather than the key, so spans for
+// different keys group together
+func route(path string) string {
+	if len(path) > 5 && path[:5] == "/mec/" {
+		return "/mec/:key"
+	}
+	return path
+}
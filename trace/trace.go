@@ -0,0 +1,177 @@
+package trace
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Spans for following a request from the node coordinating it to each
+// replica and back. A span's context travels to other nodes as a W3C
+// traceparent, in HTTP headers and in an option frame on cluster messages.
+//
+// Every method works on a nil *Span and does nothing, so code can trace
+// unconditionally and costs nothing while tracing is off.
+
+type TraceID [16]byte
+type SpanID [8]byte
+
+func (t TraceID) String() string { return hex.EncodeToString(t[:]) }
+func (s SpanID) String() string  { return hex.EncodeToString(s[:]) }
+
+// Kinds of span, as OTLP numbers them
+const (
+	Internal = 1
+	Server   = 2
+	Client   = 3
+)
+
+type Span struct {
+	Trace  TraceID
+	ID     SpanID
+	Parent SpanID // zero for a root span
+	Name   string
+	Kind   int
+	Start  time.Time
+
+	mu     sync.Mutex
+	end    time.Time
+	attrs  map[string]string
+	failed string // error message; the span's status is an error if set
+}
+
+func newID(b []byte) {
+	rand.Read(b)
+}
+
+// Start begins a span. traceparent continues a trace started elsewhere;
+// when it's empty or malformed a new trace begins. Start returns nil while
+// tracing is off.
+func Start(name string, kind int, traceparent string) *Span {
+	if !Enabled() {
+		return nil
+	}
+	sp := &Span{Name: name, Kind: kind, Start: time.Now()}
+	if tr, parent, ok := Parse(traceparent); ok {
+		sp.Trace, sp.Parent = tr, parent
+	} else {
+		newID(sp.Trace[:])
+	}
+	newID(sp.ID[:])
+	return sp
+}
+
+// Child begins a span inside this one
+func (sp *Span) Child(name string, kind int) *Span {
+	if sp == nil {
+		return nil
+	}
+	c := &Span{Trace: sp.Trace, Parent: sp.ID, Name: name, Kind: kind, Start: time.Now()}
+	newID(c.ID[:])
+	return c
+}
+
+// Set records an attribute, eg the key or peer
+func (sp *Span) Set(name string, value interface{}) {
+	if sp == nil {
+		return
+	}
+	sp.mu.Lock()
+	defer sp.mu.Unlock()
+	if sp.attrs == nil {
+		sp.attrs = make(map[string]string)
+	}
+	sp.attrs[name] = fmt.Sprint(value)
+}
+
+// Fail marks the span as having gone wrong
+func (sp *Span) Fail(msg string) {
+	if sp == nil {
+		return
+	}
+	sp.mu.Lock()
+	defer sp.mu.Unlock()
+	sp.failed = msg
+}
+
+// End finishes the span and queues it for export. Only the first End counts.
+func (sp *Span) End() {
+	if sp == nil {
+		return
+	}
+	sp.mu.Lock()
+	if !sp.end.IsZero() {
+		sp.mu.Unlock()
+		return
+	}
+	sp.end = time.Now()
+	sp.mu.Unlock()
+	queue(sp)
+}
+
+// Traceparent is the W3C header value naming this span as the parent
+func (sp *Span) Traceparent() string {
+	if sp == nil {
+		return ""
+	}
+	return fmt.Sprintf("00-%s-%s-01", sp.Trace, sp.ID)
+}
+
+// TraceID is the hex trace ID, or "" for a nil span
+func (sp *Span) TraceID() string {
+	if sp == nil {
+		return ""
+	}
+	return sp.Trace.String()
+}
+
+// Parse reads a W3C traceparent: version-traceid-parentid-flags
+func Parse(traceparent string) (TraceID, SpanID, bool) {
+	var tr TraceID
+	var sp SpanID
+	parts := strings.Split(strings.TrimSpace(traceparent), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" {
+		return tr, sp, false
+	}
+	if b, err := hex.DecodeString(parts[1]); err != nil || len(b) != len(tr) {
+		return tr, sp, false
+	} else {
+		copy(tr[:], b)
+	}
+	if b, err := hex.DecodeString(parts[2]); err != nil || len(b) != len(sp) {
+		return tr, sp, false
+	} else {
+		copy(sp[:], b)
+	}
+	if tr == (TraceID{}) || sp == (SpanID{}) {
+		return tr, sp, false
+	}
+	return tr, sp, true
+}
+
+// Cluster messages carry the traceparent as a trailing "tp=" frame, after
+// the frames the message type needs.
+const framePrefix = "tp="
+
+// Frame is the option frame to append to a message sent on sp's behalf,
+// or nil for a nil span.
+func (sp *Span) Frame() []string {
+	if sp == nil {
+		return nil
+	}
+	return []string{framePrefix + sp.Traceparent()}
+}
+
+// FromFrames starts a Server span continuing the trace in a message's
+// option frames, if there is one.
+func FromFrames(name string, frames []string) *Span {
+	for _, f := range frames {
+		if strings.HasPrefix(f, framePrefix) {
+			return Start(name, Server, strings.TrimPrefix(f, framePrefix))
+		}
+	}
+	return nil
+}
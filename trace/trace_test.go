@@ -0,0 +1,69 @@
+package trace
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	tr, sp, ok := Parse("00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	if !ok || tr.String() != "4bf92f3577b34da6a3ce929d0e0e4736" || sp.String() != "00f067aa0ba902b7" {
+		t.Error("parsed", tr, sp, ok)
+	}
+	for _, bad := range []string{
+		"",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7",
+		"00-00000000000000000000000000000000-00f067aa0ba902b7-01",
+		"ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+		"00-xyz-00f067aa0ba902b7-01",
+	} {
+		if _, _, ok := Parse(bad); ok {
+			t.Errorf("accepted %q", bad)
+		}
+	}
+}
+
+type nowhere struct{ bodies [][]byte }
+
+func (n *nowhere) Export(body []byte) error {
+	n.bodies = append(n.bodies, body)
+	return nil
+}
+
+func TestPropagateAndExport(t *testing.T) {
+	if Start("off", Server, "") != nil {
+		t.Fatal("made a span with tracing off")
+	}
+	var nilSpan *Span
+	nilSpan.Set("key", "k")
+	nilSpan.End()
+	if nilSpan.Frame() != nil {
+		t.Error("nil span made a frame")
+	}
+
+	exp := &nowhere{}
+	Configure("n1", exp)
+	root := Start("GET /mec/:key", Server, "")
+	trip := root.Child("GET n2", Client)
+	remote := FromFrames("replica read", append([]string{"routing", "GET", "k"}, trip.Frame()...))
+	if remote == nil || remote.Trace != root.Trace || remote.Parent != trip.ID {
+		t.Fatal("trace didn't cross the message:", remote)
+	}
+	remote.Fail("not found")
+	for _, sp := range []*Span{remote, trip, root} {
+		sp.End()
+	}
+	Close()
+
+	if len(exp.bodies) != 1 {
+		t.Fatal("exported", len(exp.bodies), "batches")
+	}
+	var req otlpRequest
+	if err := json.Unmarshal(exp.bodies[0], &req); err != nil {
+		t.Fatal(err)
+	}
+	spans := req.ResourceSpans[0].ScopeSpans[0].Spans
+	if len(spans) != 3 || spans[0].Status.Code != 2 || spans[2].ParentSpanID != "" || spans[1].ParentSpanID != root.ID.String() {
+		t.Error("exported", string(exp.bodies[0]))
+	}
+}